@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// requireAdmin — Authorization: Bearer <ADMIN_TOKEN>. Без токена админка не монтируется вовсе.
+// Нет или не тот токен — 401 с WWW-Authenticate (RFC 9110 §11.6.1).
+func (a *App) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="imgproxy-admin"`)
+			a.writeError(w, r, newError(errUnauthorized, "admin token required", nil))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *App) adminRoutes(r chi.Router) {
+	r.Use(a.requireAdmin)
+	r.Post("/render/{type}/{id}/{hash}", a.handleAdminRender)
+	r.Get("/storage", a.handleAdminStorage)
+	r.Post("/purge/{type}/{id}", a.handleAdminPurge)
+	r.Post("/purge/{type}/{id}/{hash}", a.handleAdminPurge)
+}
+
+// handleAdminRender — отрендерить все пресеты для картинки. ?force=1 — перезаписать существующие.
+func (a *App) handleAdminRender(w http.ResponseWriter, r *http.Request) {
+	typ := chi.URLParam(r, "type")
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id <= 0 {
+		a.writeError(w, r, errBadRequestf("bad id"))
+		return
+	}
+	hash := chi.URLParam(r, "hash")
+	if len(a.presets.forType(typ)) == 0 {
+		a.writeError(w, r, errBadRequestf("no presets configured for %s", typ))
+		return
+	}
+
+	results, err := a.renderPresets(r.Context(), typ, id, hash, envBoolValue(r.URL.Query().Get("force")))
+	if err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"type": typ, "id": id, "hash": hash, "results": results})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
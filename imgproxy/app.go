@@ -1,26 +1,28 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"imgproxy/sign"
 )
 
 type App struct {
-	db *sql.DB
+	db    *sql.DB
+	reads *readReplicas
 
 	s3     *s3.Client
 	bucket string
@@ -29,62 +31,122 @@ type App struct {
 	httpClient *http.Client
 	maxFetch   int64
 	maxRedir   int
-	uploadSem  chan struct{}
+
+	rewriteRules []rewriteRule
+	errorJSON    bool
+
+	spoolMem int64
+	spoolDir string
+
+	redirect    *storageRedirect
+	urlVerifier *sign.Verifier
+	hotlink     *hotlinkPolicy
+	limits      *rateLimits
+	resizePool  *workPool
+	degrade     *degradePolicy
+	jobs        jobQueue
+	uploads     *uploadQueue
+	derive      *derivePolicy
+	presets     *presetConfig
+	adminToken  string
+	breaker     *circuitBreaker
+	purgeHook   *purgeWebhook
+	changes     *changeFeed
+	ready       *readiness
+
+	caps         atomic.Pointer[storageCaps]
+	shuttingDown atomic.Bool
 }
 
 func newApp() (*App, error) {
 	// --- MySQL
-	dsn := env("MYSQL_DSN", "")
-	if dsn == "" {
-		return nil, errors.New("missing MYSQL_DSN")
-	}
-	db, err := sql.Open("mysql", dsn)
+	db, reads, err := loadMySQL()
 	if err != nil {
 		return nil, err
 	}
-	db.SetMaxOpenConns(20)
-	db.SetMaxIdleConns(10)
-	db.SetConnMaxLifetime(30 * time.Minute)
-	if err := db.Ping(); err != nil {
-		return nil, fmt.Errorf("mysql ping: %w", err)
-	}
 
 	// --- S3/R2
-	accessKey := env("S3_ACCESS_KEY", "")
-	secretKey := env("S3_SECRET_KEY", "")
-	if secretKey == "" {
-		secretKeyFile := env("S3_SECRET_KEY_FILE", "")
-		sk, err := os.ReadFile(secretKeyFile)
-		if err == nil {
-			secretKey = strings.TrimSpace(string(sk))
-		}
-	}
 	endpoint := env("S3_ENDPOINT", "")
 	region := env("S3_REGION", "auto")
 	bucket := env("S3_BUCKET", "")
 	prefix := env("S3_PREFIX", "cdnhub/sss")
 
-	if bucket == "" || endpoint == "" || accessKey == "" || secretKey == "" {
-		return nil, errors.New("missing S3_* envs")
+	if bucket == "" || endpoint == "" {
+		return nil, errors.New("missing S3_BUCKET or S3_ENDPOINT")
 	}
 
-	cfg, err := config.LoadDefaultConfig(context.Background(),
-		config.WithRegion(region),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKey, secretKey, "")),
-	)
+	creds, err := loadS3Credentials()
+	if err != nil {
+		return nil, fmt.Errorf("s3 credentials: %w", err)
+	}
+	cfgOpts := []func(*config.LoadOptions) error{config.WithRegion(region)}
+	if creds != nil {
+		cfgOpts = append(cfgOpts, config.WithCredentialsProvider(creds))
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), cfgOpts...)
 	if err != nil {
 		return nil, err
 	}
+	if creds == nil {
+		// без S3_ACCESS_KEY — стандартная цепочка AWS; проверяем, что она что-то нашла
+		c, err := cfg.Credentials.Retrieve(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("s3 credentials: no S3_ACCESS_KEY/S3_SECRET_KEY and the AWS default chain found nothing: %w", err)
+		}
+		slog.Info("s3 credentials from AWS default chain", "source", c.Source)
+	}
 
 	s3c := s3.NewFromConfig(cfg, func(o *s3.Options) {
 		o.BaseEndpoint = aws.String(endpoint)
 		o.UsePathStyle = true
+		o.APIOptions = append(o.APIOptions, traceS3)
 	})
 
+	redirect, err := loadStorageRedirect(s3c)
+	if err != nil {
+		return nil, err
+	}
+
+	urlVerifier, err := loadURLVerifier()
+	if err != nil {
+		return nil, err
+	}
+
+	hotlink, err := loadHotlinkPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	limits, err := loadRateLimits()
+	if err != nil {
+		return nil, err
+	}
+
+	jobs, err := newJobQueue(db)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := loadChangeFeed(db)
+	if err != nil {
+		return nil, err
+	}
+
+	presets, err := loadPresets()
+	if err != nil {
+		return nil, err
+	}
+
 	timeout := envDuration("HTTP_TIMEOUT", 10*time.Second)
 
+	rewriteRules, err := loadRewriteRules()
+	if err != nil {
+		return nil, err
+	}
+
 	app := &App{
-		db: db,
+		db:    db,
+		reads: reads,
 
 		s3:     s3c,
 		bucket: bucket,
@@ -93,48 +155,62 @@ func newApp() (*App, error) {
 		httpClient: &http.Client{Timeout: timeout},
 		maxFetch:   envInt64("MAX_FETCH_BYTES", 10<<20),
 		maxRedir:   5,
-		uploadSem:  make(chan struct{}, 32),
-	}
 
+		rewriteRules: rewriteRules,
+		errorJSON:    envBool("ERROR_JSON", false),
+
+		spoolMem: envInt64("SPOOL_MEM_BYTES", 1<<20),
+		spoolDir: env("SPOOL_DIR", os.TempDir()),
+
+		redirect:    redirect,
+		urlVerifier: urlVerifier,
+		hotlink:     hotlink,
+		limits:      limits,
+		resizePool: newWorkPool(
+			int(envInt64("RESIZE_WORKERS", 0)),
+			int(envInt64("RESIZE_QUEUE", -1)),
+			envDuration("RESIZE_QUEUE_TIMEOUT", 2*time.Second),
+		),
+		degrade: loadDegradePolicy(),
+		jobs:    jobs,
+		derive:  loadDerivePolicy(),
+
+		presets:    presets,
+		adminToken: env("ADMIN_TOKEN", ""),
+		breaker:    loadCircuitBreaker(),
+		purgeHook:  loadPurgeWebhook(),
+		changes:    changes,
+		ready:      loadReadiness(),
+	}
+
+	app.caps.Store(unknownStorageCaps())
 	if envBool("S3_INIT_CHECK", true) {
 		if err := app.checkS3Access(context.Background()); err != nil {
 			return nil, err
 		}
 	} else {
-		log.Printf("s3 init access checks are disabled (S3_INIT_CHECK=false)")
+		slog.Warn("s3 init access checks are disabled (S3_INIT_CHECK=false)")
+	}
+
+	uploads, err := newUploadQueue(app)
+	if err != nil {
+		return nil, fmt.Errorf("upload queue: %w", err)
 	}
+	app.uploads = uploads
+	uploads.start()
 
 	return app, nil
 }
 
-func (a *App) checkS3Access(ctx context.Context) error {
-	checkCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
-
-	probePrefix := strings.TrimSuffix(a.prefix, "/")
-	if probePrefix == "" {
-		probePrefix = "cdnhub/sss"
-	}
-	probeBase := fmt.Sprintf("%s/__init_access_probe/%d", probePrefix, time.Now().UnixNano())
-	readProbeKey := probeBase + "-read-miss"
-	writeProbeKey := probeBase + "-write"
+func (a *App) newSpool() *spool {
+	return newSpool(a.spoolMem, a.spoolDir)
+}
 
-	if err := a.checkS3Read(checkCtx, readProbeKey); err != nil {
-		return err
+func (a *App) probePrefix() string {
+	if p := strings.TrimSuffix(a.prefix, "/"); p != "" {
+		return p
 	}
-	if err := a.checkS3Write(checkCtx, writeProbeKey); err != nil {
-		return err
-	}
-	if err := a.checkS3Head(checkCtx, readProbeKey); err != nil {
-		if isS3AccessDenied(err) {
-			log.Printf("s3 head access denied, continue without HeadObject: %v", err)
-		} else {
-			return err
-		}
-	}
-
-	log.Printf("s3 access checks passed: read/write ok")
-	return nil
+	return "cdnhub/sss"
 }
 
 func (a *App) checkS3Read(ctx context.Context, key string) error {
@@ -155,45 +231,6 @@ func (a *App) checkS3Read(ctx context.Context, key string) error {
 	return nil
 }
 
-func (a *App) checkS3Write(ctx context.Context, key string) error {
-	_, err := a.s3.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(a.bucket),
-		Key:         aws.String(key),
-		Body:        bytes.NewReader([]byte("ok")),
-		ContentType: aws.String("text/plain"),
-	})
-	if err != nil {
-		if isS3AccessDenied(err) {
-			return fmt.Errorf("s3 write access denied (PutObject): %w", err)
-		}
-		return fmt.Errorf("s3 write check failed (PutObject): %w", err)
-	}
-
-	if _, err := a.s3.DeleteObject(ctx, &s3.DeleteObjectInput{
-		Bucket: aws.String(a.bucket),
-		Key:    aws.String(key),
-	}); err != nil {
-		log.Printf("s3 access check cleanup warning (DeleteObject): key=%s err=%v", key, err)
-	}
-
-	return nil
-}
-
-func (a *App) checkS3Head(ctx context.Context, key string) error {
-	_, err := a.s3.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(a.bucket),
-		Key:    aws.String(key),
-	})
-	if err == nil || isS3NotFound(err) {
-		log.Println("s3 HeadObject OK")
-		return nil
-	}
-	if isS3AccessDenied(err) {
-		return fmt.Errorf("s3 head access denied (HeadObject): %w", err)
-	}
-	return fmt.Errorf("s3 head check failed (HeadObject): %w", err)
-}
-
 func isS3NotFound(err error) bool {
 	var nsk *types.NoSuchKey
 	if errors.As(err, &nsk) {
@@ -203,6 +240,11 @@ func isS3NotFound(err error) bool {
 	return strings.Contains(msg, "NoSuchKey") || strings.Contains(msg, "NotFound")
 }
 
+func isS3InvalidRange(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "InvalidRange") || strings.Contains(msg, "StatusCode: 416")
+}
+
 func isS3AccessDenied(err error) bool {
 	msg := strings.ToLower(err.Error())
 	return strings.Contains(msg, "accessdenied") || strings.Contains(msg, "forbidden") || strings.Contains(msg, "statuscode: 403")
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+type presetConfig struct {
+	defaults []string
+	byType   map[string][]string
+	eager    bool
+}
+
+// loadPresets: PRESETS — ресайзы для всех типов (600,h300), PRESETS_<TYPE> — для типа.
+func loadPresets() (*presetConfig, error) {
+	pc := &presetConfig{
+		defaults: splitList(env("PRESETS", "")),
+		byType:   map[string][]string{},
+		eager:    envBool("PRESETS_EAGER", true),
+	}
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		if typ, ok := strings.CutPrefix(k, "PRESETS_"); ok && typ != "EAGER" && typ != "" {
+			pc.byType[strings.ToLower(typ)] = splitList(v)
+		}
+	}
+	for _, list := range append([][]string{pc.defaults}, mapValues(pc.byType)...) {
+		for _, p := range list {
+			if _, _, err := parseResize(p); err != nil {
+				return nil, fmt.Errorf("bad preset %q: %w", p, err)
+			}
+		}
+	}
+	return pc, nil
+}
+
+func mapValues(m map[string][]string) [][]string {
+	out := make([][]string, 0, len(m))
+	for _, v := range m {
+		out = append(out, v)
+	}
+	return out
+}
+
+func (pc *presetConfig) forType(typ string) []string {
+	if v, ok := pc.byType[strings.ToLower(typ)]; ok {
+		return v
+	}
+	return pc.defaults
+}
+
+// afterIngest вызывается, когда новый оригинал лёг в S3.
+func (a *App) afterIngest(typ string, id int, hash string) {
+	if !a.presets.eager || len(a.presets.forType(typ)) == 0 {
+		return
+	}
+	a.jobs.enqueue(variantJob{typ: typ, id: id, hash: hash})
+}
+
+type presetResult struct {
+	Variant string `json:"variant"`
+	Status  string `json:"status"` // ok, exists, error
+	Bytes   int    `json:"bytes,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// renderPresets декодирует оригинал один раз и параллельно кодирует все пресеты типа (webp, как и ресайзы на лету).
+// force=false — уже существующие варианты пропускаем.
+func (a *App) renderPresets(ctx context.Context, typ string, id int, hash string, force bool) ([]presetResult, error) {
+	var todo []presetResult
+	for _, p := range a.presets.forType(typ) {
+		res := presetResult{Variant: p}
+		if !force {
+			exists, err := a.objectExists(ctx, a.objectKey(typ, id, variantName(hash, p)))
+			if err != nil {
+				return nil, storageError("storage error", err)
+			}
+			if exists {
+				res.Status = "exists"
+			}
+		}
+		todo = append(todo, res)
+	}
+	if !hasPending(todo) {
+		return todo, nil
+	}
+
+	src, err := a.openOriginalSource(ctx, typ, id, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	release, err := a.resizePool.acquireIdle(ctx)
+	if err != nil {
+		src.finish(ctx, true)
+		return nil, err
+	}
+	_, span := startSpan(ctx, "image.decode")
+	img, err := decodeImage(src.rd)
+	endSpan(span, err)
+	release()
+	src.finish(ctx, err == nil)
+	if err != nil {
+		return nil, err
+	}
+	meta := src.lineageMeta(img.Bounds().Size())
+
+	var wg sync.WaitGroup
+	for i := range todo {
+		if todo[i].Status != "" {
+			continue
+		}
+		wg.Add(1)
+		go func(res *presetResult) {
+			defer wg.Done()
+			out, err := a.encodePreset(ctx, img, res.Variant)
+			if err != nil {
+				res.Status, res.Error = "error", err.Error()
+				return
+			}
+			res.Status, res.Bytes = "ok", len(out)
+			a.uploadAsync(ctx, a.objectKey(typ, id, variantName(hash, res.Variant)), "image/webp", spoolBytes(out), meta)
+		}(&todo[i])
+	}
+	wg.Wait()
+	slog.InfoContext(ctx, "presets rendered", "type", typ, "id", id, "hash", hash, "variants", len(todo))
+	return todo, nil
+}
+
+func (a *App) encodePreset(ctx context.Context, img image.Image, resize string) ([]byte, error) {
+	release, err := a.resizePool.acquireIdle(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return encodeResized(ctx, img, resize)
+}
+
+func hasPending(rs []presetResult) bool {
+	for _, r := range rs {
+		if r.Status == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *App) objectExists(ctx context.Context, key string) (bool, error) {
+	_, ok, err := a.statObject(ctx, key)
+	return ok, err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// circuitBreaker — по хосту апстрима. После failures ошибок подряд хост «открыт» на cooldown:
+// запросы к нему сразу получают 502, не занимая соединения и таймаут. Потом пропускаем один пробный запрос.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	failures int
+	cooldown time.Duration
+	hosts    map[string]*breakerState
+}
+
+type breakerState struct {
+	fails     int
+	openUntil time.Time
+	probing   bool
+}
+
+func loadCircuitBreaker() *circuitBreaker {
+	if !envBool("UPSTREAM_BREAKER", true) {
+		return nil
+	}
+	return &circuitBreaker{
+		failures: int(envInt64("UPSTREAM_BREAKER_FAILURES", 5)),
+		cooldown: envDuration("UPSTREAM_BREAKER_COOLDOWN", 30*time.Second),
+		hosts:    map[string]*breakerState{},
+	}
+}
+
+func upstreamHost(u string) string {
+	if p, err := url.Parse(u); err == nil && p.Host != "" {
+		return p.Host
+	}
+	return originOf(u)
+}
+
+// allow — можно ли идти в host. После allow обязателен record.
+func (b *circuitBreaker) allow(host string, now time.Time) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.hosts[host]
+	if st == nil || st.fails < b.failures {
+		return nil
+	}
+	if now.Before(st.openUntil) || st.probing {
+		e := newError(errUpstreamUnavailable, "upstream unavailable", fmt.Errorf("circuit open for %s", host))
+		e.retryAfter = max(st.openUntil.Sub(now), time.Second)
+		return e
+	}
+	st.probing = true
+	return nil
+}
+
+func (b *circuitBreaker) record(host string, ok bool, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.hosts[host]
+	if ok {
+		if st != nil {
+			if st.fails >= b.failures {
+				upstreamBreakerOpen.WithLabelValues(host).Set(0)
+			}
+			delete(b.hosts, host)
+		}
+		return
+	}
+	if st == nil {
+		st = &breakerState{}
+		b.hosts[host] = st
+	}
+	st.fails++
+	st.probing = false
+	if st.fails >= b.failures {
+		st.openUntil = now.Add(b.cooldown)
+		upstreamBreakerOpen.WithLabelValues(host).Set(1)
+	}
+}
+
+// release — запрос не дал ответа по нашей вине (отмена): состояние не меняем, но отпускаем пробу.
+func (b *circuitBreaker) release(host string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if st := b.hosts[host]; st != nil {
+		st.probing = false
+	}
+}
+
+// openHosts — хосты, которые сейчас открыты (для /readyz).
+func (b *circuitBreaker) openHosts() []string {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []string
+	for h, st := range b.hosts {
+		if st.fails >= b.failures {
+			out = append(out, h)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
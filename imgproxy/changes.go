@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// changeFeed — журнал изменений URL картинок (таблица imgproxy_changes, её заполняют триггеры
+// на таблицах сущностей, см. mysql/init.sql). Разбирает его один под: лидер держит GET_LOCK, остальные ждут.
+//
+// Сменился URL — старый hash осиротел, удаляем его оригинал и ресайзы. Новый hash удаляем и заново
+// заливаем оригинал, за ним — пресеты. UPDATE без смены URL (old_url = new_url) тоже в журнале:
+// перекачиваем и пересобираем, только если md5 разошёлся с оригиналом в S3.
+type changeFeed struct {
+	db          *sql.DB
+	table       string
+	poll        time.Duration
+	batch       int
+	maxAttempts int
+}
+
+type urlChange struct {
+	id     int64
+	typ    string
+	entity int
+	oldURL string
+	newURL string
+}
+
+func (c urlChange) String() string {
+	return fmt.Sprintf("%s/%d#%d", c.typ, c.entity, c.id)
+}
+
+func loadChangeFeed(db *sql.DB) (*changeFeed, error) {
+	if !envBool("CHANGE_FEED", false) {
+		return nil, nil
+	}
+	f := &changeFeed{
+		db:          db,
+		table:       env("CHANGE_FEED_TABLE", "imgproxy_changes"),
+		poll:        envDuration("CHANGE_FEED_POLL", 5*time.Second),
+		batch:       int(envInt64("CHANGE_FEED_BATCH", 100)),
+		maxAttempts: int(envInt64("CHANGE_FEED_MAX_ATTEMPTS", 5)),
+	}
+	if err := f.migrate(context.Background()); err != nil {
+		return nil, fmt.Errorf("change feed table: %w", err)
+	}
+	return f, nil
+}
+
+func (f *changeFeed) migrate(ctx context.Context) error {
+	_, err := f.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+f.table+` (
+  id bigint unsigned NOT NULL AUTO_INCREMENT,
+  type varchar(32) NOT NULL,
+  entity_id int NOT NULL,
+  old_url varchar(255) NULL,
+  new_url varchar(255) NULL,
+  attempts int NOT NULL DEFAULT 0,
+  last_error varchar(255) NULL,
+  created_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (id)
+)`)
+	return err
+}
+
+// runChanges разбирает журнал, пока ctx жив. Без CHANGE_FEED сразу возвращается.
+func (a *App) runChanges(ctx context.Context) {
+	f := a.changes
+	if f == nil {
+		return
+	}
+	for {
+		if err := f.lead(ctx, a.applyChange); err != nil && ctx.Err() == nil {
+			slog.Warn("change feed failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(f.poll):
+		}
+	}
+}
+
+// lead — если лок наш, разбираем журнал до отмены ctx; если нет — сразу выходим.
+func (f *changeFeed) lead(ctx context.Context, apply func(context.Context, urlChange) error) error {
+	conn, err := f.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var got sql.NullInt64
+	if err := conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, 0)`, f.table).Scan(&got); err != nil {
+		return err
+	}
+	if got.Int64 != 1 {
+		return nil
+	}
+	defer func() {
+		var released sql.NullInt64
+		_ = conn.QueryRowContext(context.Background(), `SELECT RELEASE_LOCK(?)`, f.table).Scan(&released)
+	}()
+
+	for {
+		n, err := f.drain(ctx, conn, apply)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(f.poll):
+		}
+	}
+}
+
+func (f *changeFeed) drain(ctx context.Context, conn *sql.Conn, apply func(context.Context, urlChange) error) (int, error) {
+	rows, err := conn.QueryContext(ctx,
+		`SELECT id, type, entity_id, COALESCE(old_url, ''), COALESCE(new_url, '') FROM `+f.table+`
+		 WHERE attempts < ? ORDER BY id LIMIT ?`, f.maxAttempts, f.batch)
+	if err != nil {
+		return 0, err
+	}
+	var batch []urlChange
+	for rows.Next() {
+		var c urlChange
+		if err := rows.Scan(&c.id, &c.typ, &c.entity, &c.oldURL, &c.newURL); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// одинаковые записи без смены URL (строку сущности обновили несколько раз) проверяем один раз за пачку
+	refreshed := map[urlChange]bool{}
+	for _, c := range batch {
+		if ctx.Err() != nil {
+			return 0, nil
+		}
+		same := c.oldURL == c.newURL
+		dedup := urlChange{typ: c.typ, entity: c.entity, newURL: c.newURL}
+		if same && refreshed[dedup] {
+			changesApplied.WithLabelValues("ok").Inc()
+			if _, err := conn.ExecContext(ctx, `DELETE FROM `+f.table+` WHERE id = ?`, c.id); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err := apply(ctx, c); err != nil {
+			slog.WarnContext(ctx, "change apply failed", "change", c.String(), "err", err)
+			changesApplied.WithLabelValues("error").Inc()
+			msg := err.Error()
+			if len(msg) > 255 {
+				msg = msg[:255]
+			}
+			if _, err := conn.ExecContext(ctx, `UPDATE `+f.table+` SET attempts = attempts + 1, last_error = ? WHERE id = ?`, msg, c.id); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if same {
+			refreshed[dedup] = true
+		}
+		changesApplied.WithLabelValues("ok").Inc()
+		if _, err := conn.ExecContext(ctx, `DELETE FROM `+f.table+` WHERE id = ?`, c.id); err != nil {
+			return 0, err
+		}
+	}
+	return len(batch), nil
+}
+
+// applyChange: purge старого hash, затем свежая заливка нового.
+func (a *App) applyChange(ctx context.Context, c urlChange) error {
+	var oldHash, newHash string
+	if c.oldURL != "" {
+		oldHash = md5hex(c.oldURL)
+	}
+	if c.newURL != "" {
+		newHash = md5hex(c.newURL)
+	}
+
+	if oldHash != "" && oldHash != newHash {
+		if _, err := a.purge(ctx, c.typ, c.entity, oldHash); err != nil {
+			return fmt.Errorf("purge old: %w", err)
+		}
+	}
+	if newHash == "" {
+		return nil
+	}
+	return a.reingest(ctx, c, newHash, oldHash == newHash)
+}
+
+// reingest качает c.newURL напрямую, без резолвера: тот читает с реплик, и из-за лага нового URL
+// там может ещё не быть — запись журнала удалилась бы, так ничего и не залив.
+// Новый hash мог быть закеширован раньше (вернули старую картинку), поэтому перед заливкой его чистим.
+// Для того же URL (old_url = new_url) сначала сравниваем md5 с оригиналом в S3: совпал — ничего не трогаем.
+func (a *App) reingest(ctx context.Context, c urlChange, hash string, sameURL bool) error {
+	remote, err := a.fetchOriginal(ctx, c.newURL)
+	if err != nil {
+		if errorKind(err) != errNotFound {
+			return err
+		}
+		// у апстрима картинки нет — заливать нечего, только убираем то, что лежит под этим hash
+		if _, err := a.purge(ctx, c.typ, c.entity, hash); err != nil {
+			return fmt.Errorf("purge new: %w", err)
+		}
+		return nil
+	}
+	defer remote.Close()
+	sp := a.newSpool()
+	if _, err := io.Copy(sp, remote); err != nil {
+		sp.Close()
+		return err
+	}
+
+	origKey := a.objectKey(c.typ, c.entity, hash)
+	if sameURL {
+		info, ok, err := a.statObject(ctx, origKey)
+		if err != nil {
+			sp.Close()
+			return err
+		}
+		if ok && info.etag == sp.MD5() {
+			slog.DebugContext(ctx, "change skipped, content unchanged", "change", c.String(), "hash", hash)
+			sp.Close()
+			return nil
+		}
+	}
+	if _, err := a.purge(ctx, c.typ, c.entity, hash); err != nil {
+		sp.Close()
+		return fmt.Errorf("purge new: %w", err)
+	}
+	slog.InfoContext(ctx, "change applied, re-ingesting", "change", c.String(), "hash", hash)
+	// после заливки afterIngest отрендерит пресеты
+	a.uploadIngest(ctx, origKey, remote.contentType, sp, c.typ, c.entity, hash)
+	return nil
+}
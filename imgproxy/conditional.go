@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// notModified — условные GET/HEAD по RFC 9110 (§13.1.2, §13.1.3, §13.2.2):
+// If-None-Match (список, *, слабое сравнение) важнее If-Modified-Since.
+func notModified(r *http.Request, etag string, lastMod time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagListMatch(inm, etag)
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastMod.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		return !lastMod.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// etagListMatch — слабое сравнение: W/"x" совпадает с "x".
+// Голые значения без кавычек тоже принимаем — раньше мы так отдавали ETag.
+func etagListMatch(list, etag string) bool {
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "*" {
+			return true
+		}
+		if etag == "" {
+			continue
+		}
+		item = strings.TrimPrefix(item, "W/")
+		if strings.Trim(item, `"`) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNotModified — 304 с теми же валидаторами и Cache-Control, что и у 200.
+func writeNotModified(w http.ResponseWriter, r *http.Request, ct, etag string, lastMod time.Time, source string, dur time.Duration) {
+	writeCommon(w, r, ct, etag, source, dur)
+	setLastModified(w, lastMod)
+	w.Header().Del("Content-Type")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+func setLastModified(w http.ResponseWriter, t time.Time) {
+	if !t.IsZero() {
+		w.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+	}
+}
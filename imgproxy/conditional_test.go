@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestETagListMatch(t *testing.T) {
+	for _, tc := range []struct {
+		list, etag string
+		want       bool
+	}{
+		{`"abc"`, "abc", true},
+		{`W/"abc"`, "abc", true},
+		{"abc", "abc", true},
+		{`"x", "abc"`, "abc", true},
+		{`"x","y"`, "abc", false},
+		{"*", "abc", true},
+		{"*", "", true},
+		{`"abc"`, "", false},
+		{`"abcd"`, "abc", false},
+	} {
+		if got := etagListMatch(tc.list, tc.etag); got != tc.want {
+			t.Errorf("etagListMatch(%q, %q) = %v, want %v", tc.list, tc.etag, got, tc.want)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	lastMod := time.Date(2024, 1, 2, 3, 4, 5, 600, time.UTC)
+	for _, tc := range []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    bool
+	}{
+		{"no validators", http.MethodGet, nil, false},
+		{"etag match", http.MethodGet, map[string]string{"If-None-Match": `"abc"`}, true},
+		{"etag match on HEAD", http.MethodHead, map[string]string{"If-None-Match": `"abc"`}, true},
+		{"etag mismatch", http.MethodGet, map[string]string{"If-None-Match": `"x"`}, false},
+		{"POST is never 304", http.MethodPost, map[string]string{"If-None-Match": `"abc"`}, false},
+		{"ims same second", http.MethodGet, map[string]string{"If-Modified-Since": lastMod.Format(http.TimeFormat)}, true},
+		{"ims later", http.MethodGet, map[string]string{"If-Modified-Since": lastMod.Add(time.Hour).Format(http.TimeFormat)}, true},
+		{"ims earlier", http.MethodGet, map[string]string{"If-Modified-Since": lastMod.Add(-time.Hour).Format(http.TimeFormat)}, false},
+		{"ims garbage", http.MethodGet, map[string]string{"If-Modified-Since": "yesterday"}, false},
+		// If-None-Match важнее: не совпал — If-Modified-Since уже не смотрим
+		{"inm wins over ims", http.MethodGet, map[string]string{
+			"If-None-Match":     `"x"`,
+			"If-Modified-Since": lastMod.Add(time.Hour).Format(http.TimeFormat),
+		}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/sss/videos/1/abc", nil)
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			if got := notModified(r, "abc", lastMod); got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-Modified-Since", lastMod.Format(http.TimeFormat))
+	if notModified(r, "abc", time.Time{}) {
+		t.Error("If-Modified-Since without Last-Modified must not give 304")
+	}
+}
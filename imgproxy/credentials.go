@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// fileCredentials — ключи S3 из env и/или файлов (k8s secret, vault agent). Файлы перечитываются,
+// когда у них меняется mtime: SDK спрашивает ключи заново раз в refresh, ротация — без рестарта.
+type fileCredentials struct {
+	mu sync.Mutex
+
+	access, secret, token             string // из env
+	accessFile, secretFile, tokenFile string
+	refresh                           time.Duration
+
+	mtimes map[string]time.Time
+	cur    aws.Credentials
+	loaded bool
+}
+
+// loadS3Credentials: nil — статических ключей нет, работает стандартная цепочка AWS
+// (AWS_ACCESS_KEY_ID, ~/.aws/config, web identity, IMDS).
+func loadS3Credentials() (*fileCredentials, error) {
+	p := &fileCredentials{
+		access:     env("S3_ACCESS_KEY", ""),
+		secret:     env("S3_SECRET_KEY", ""),
+		token:      env("S3_SESSION_TOKEN", ""),
+		accessFile: env("S3_ACCESS_KEY_FILE", ""),
+		secretFile: env("S3_SECRET_KEY_FILE", ""),
+		tokenFile:  env("S3_SESSION_TOKEN_FILE", ""),
+		refresh:    envDuration("S3_CREDENTIALS_REFRESH", time.Minute),
+		mtimes:     map[string]time.Time{},
+	}
+	hasAccess := p.access != "" || p.accessFile != ""
+	hasSecret := p.secret != "" || p.secretFile != ""
+	switch {
+	case !hasAccess && !hasSecret:
+		return nil, nil
+	case !hasAccess:
+		return nil, errors.New("S3_SECRET_KEY/S3_SECRET_KEY_FILE is set but S3_ACCESS_KEY/S3_ACCESS_KEY_FILE is not")
+	case !hasSecret:
+		return nil, errors.New("S3_ACCESS_KEY/S3_ACCESS_KEY_FILE is set but S3_SECRET_KEY/S3_SECRET_KEY_FILE is not")
+	}
+	// ошибки чтения файлов — сразу при старте, а не первым запросом в бакет
+	if _, err := p.Retrieve(context.Background()); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *fileCredentials) usesFiles() bool {
+	return p.accessFile != "" || p.secretFile != "" || p.tokenFile != ""
+}
+
+func (p *fileCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.loaded || p.filesChanged() {
+		creds, err := p.load()
+		if err != nil {
+			if !p.loaded {
+				return aws.Credentials{}, err
+			}
+			// файл в процессе замены или сломан — работаем на прежних ключах
+			slog.Warn("s3 credentials reload failed, keep previous", "err", err)
+		} else {
+			if p.loaded && creds.AccessKeyID != p.cur.AccessKeyID {
+				slog.Info("s3 credentials rotated", "access_key", maskKey(creds.AccessKeyID))
+			}
+			p.cur = creds
+			p.loaded = true
+		}
+	}
+
+	out := p.cur
+	if p.usesFiles() {
+		out.CanExpire = true
+		out.Expires = time.Now().Add(p.refresh)
+	}
+	return out, nil
+}
+
+func (p *fileCredentials) filesChanged() bool {
+	for _, f := range []string{p.accessFile, p.secretFile, p.tokenFile} {
+		if f == "" {
+			continue
+		}
+		st, err := os.Stat(f)
+		if err != nil || !st.ModTime().Equal(p.mtimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *fileCredentials) load() (aws.Credentials, error) {
+	var err error
+	creds := aws.Credentials{AccessKeyID: p.access, SecretAccessKey: p.secret, SessionToken: p.token, Source: "imgproxy-s3-keys"}
+	if creds.AccessKeyID, err = p.readKey("S3_ACCESS_KEY_FILE", p.accessFile, p.access); err != nil {
+		return aws.Credentials{}, err
+	}
+	if creds.SecretAccessKey, err = p.readKey("S3_SECRET_KEY_FILE", p.secretFile, p.secret); err != nil {
+		return aws.Credentials{}, err
+	}
+	if creds.SessionToken, err = p.readKey("S3_SESSION_TOKEN_FILE", p.tokenFile, p.token); err != nil {
+		return aws.Credentials{}, err
+	}
+	return creds, nil
+}
+
+// readKey: значение из env важнее файла — так было и раньше с S3_SECRET_KEY.
+func (p *fileCredentials) readKey(name, path, fromEnv string) (string, error) {
+	if fromEnv != "" || path == "" {
+		return fromEnv, nil
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	v := strings.TrimSpace(string(b))
+	if v == "" {
+		return "", fmt.Errorf("%s: %s is empty", name, path)
+	}
+	p.mtimes[path] = st.ModTime()
+	return v, nil
+}
+
+func maskKey(k string) string {
+	if len(k) <= 4 {
+		return "****"
+	}
+	return k[:4] + "****"
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type degradePolicy struct {
+	cacheControl string
+	minRemaining time.Duration
+}
+
+func loadDegradePolicy() *degradePolicy {
+	if !envBool("DEGRADE", true) {
+		return nil
+	}
+	return &degradePolicy{
+		cacheControl: env("DEGRADE_CACHE_CONTROL", "public, max-age=60"),
+		minRemaining: envDuration("DEGRADE_MIN_REMAINING", time.Second),
+	}
+}
+
+// withDeadline — дедлайн на запрос (REQUEST_TIMEOUT). По нему shouldDegrade решает, что ресайз
+// уже не успеть, а всё, что не уложилось, получает 504. 0 — без дедлайна.
+func withDeadline(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if d <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// shouldDegrade — пул ресайза забит или до дедлайна запроса не успеем.
+func (a *App) shouldDegrade(ctx context.Context) bool {
+	if a.degrade == nil {
+		return false
+	}
+	if a.resizePool.saturated() {
+		return true
+	}
+	if dl, ok := ctx.Deadline(); ok && time.Until(dl) < a.degrade.minRemaining {
+		return true
+	}
+	return false
+}
+
+// serveNearestVariant отдаёт ближайший уже готовый вариант (крупнее или оригинал) с коротким кешем,
+// а точный вариант ставит в фоновую генерацию.
+func (a *App) serveNearestVariant(w http.ResponseWriter, r *http.Request, typ string, id int, hash, resize string, start time.Time) bool {
+	if a.degrade == nil {
+		return false
+	}
+	// Range относится к точному варианту: кусок другого объекта под этим URL клиент склеил бы
+	// с байтами другого представления. Отдаём подмену только целиком.
+	full := r.Clone(r.Context())
+	full.Header.Del("Range")
+	full.Header.Del("If-Range")
+	for _, name := range nearestVariants(hash, resize) {
+		cw := &cacheOverrideWriter{ResponseWriter: w, cacheControl: a.degrade.cacheControl}
+		served, err := a.serveFromS3IfPresent(cw, full, a.objectKey(typ, id, name), "degraded-"+variantLabel(name), start)
+		if err != nil && !served {
+			slog.WarnContext(r.Context(), "degrade lookup failed", "variant", name, "err", err)
+			continue
+		}
+		if !served {
+			continue
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "s3 serve degraded failed", "err", err)
+		}
+		degradedServed.WithLabelValues(variantLabel(name)).Inc()
+		a.jobs.enqueue(variantJob{typ: typ, id: id, hash: hash, resize: resize})
+		return true
+	}
+	return false
+}
+
+// cacheOverrideWriter подменяет Cache-Control прямо перед отправкой заголовков.
+type cacheOverrideWriter struct {
+	http.ResponseWriter
+	cacheControl string
+}
+
+func (w *cacheOverrideWriter) WriteHeader(code int) {
+	w.Header().Set("Cache-Control", w.cacheControl)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheOverrideWriter) Write(b []byte) (int, error) {
+	return w.ResponseWriter.Write(b)
+}
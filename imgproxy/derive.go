@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type derivePolicy struct {
+	excludeTypes map[string]bool
+}
+
+// loadDerivePolicy: DERIVE_EXCLUDE_TYPES — типы, где качество важнее (всегда рендерим из оригинала).
+func loadDerivePolicy() *derivePolicy {
+	if !envBool("DERIVE", true) {
+		return nil
+	}
+	p := &derivePolicy{excludeTypes: map[string]bool{}}
+	for _, t := range splitList(env("DERIVE_EXCLUDE_TYPES", "")) {
+		p.excludeTypes[strings.ToLower(t)] = true
+	}
+	return p
+}
+
+// planDerivation ищет самый маленький готовый ресайз того же измерения, который не меньше цели
+// и сам не был растянут из оригинала меньшего размера. nil — подходящего нет, рендерим из оригинала.
+// Кандидатов проверяем без тела: если можно List — одним листингом по префиксу hash@, иначе HEAD
+// (statObject); тело открываем только у выбранного.
+func (a *App) planDerivation(ctx context.Context, typ string, id int, hash, resize string) (*variantSource, error) {
+	if a.derive == nil || a.derive.excludeTypes[strings.ToLower(typ)] {
+		return nil, nil
+	}
+	cands := largerVariants(resize)
+	if len(cands) == 0 {
+		return nil, nil
+	}
+	var present map[string]bool
+	if a.storage().List.allowed() {
+		var err error
+		if present, err = a.listVariants(ctx, typ, id, hash); err != nil {
+			return nil, err
+		}
+	}
+	for _, cand := range cands {
+		if present != nil && !present[cand] {
+			continue
+		}
+		key := a.objectKey(typ, id, variantName(hash, cand))
+		info, ok, err := a.statObject(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		origW, _ := strconv.Atoi(info.meta["orig-w"])
+		origH, _ := strconv.Atoi(info.meta["orig-h"])
+		if !acceptableSource(cand, origW, origH) {
+			continue
+		}
+		done := stage(ctx, "storage")
+		out, err := a.s3.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(a.bucket), Key: aws.String(key)})
+		done()
+		if err != nil {
+			if isS3NotFound(err) {
+				// удалили между HEAD и GET — берём следующий
+				continue
+			}
+			return nil, err
+		}
+		return &variantSource{
+			rd:      out.Body,
+			label:   "derived-" + cand,
+			code:    200,
+			lineage: cand,
+			origW:   origW,
+			origH:   origH,
+			closers: []io.Closer{out.Body},
+		}, nil
+	}
+	return nil, nil
+}
+
+// listVariants — какие ресайзы картинки уже лежат в бакете, одним ListObjectsV2 по префиксу hash@.
+func (a *App) listVariants(ctx context.Context, typ string, id int, hash string) (map[string]bool, error) {
+	defer stage(ctx, "storage")()
+	prefix := a.objectKey(typ, id, hash+"@")
+	out, err := a.s3.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(a.bucket),
+		Prefix: aws.String(prefix),
+	})
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool, len(out.Contents))
+	for _, obj := range out.Contents {
+		present[strings.TrimPrefix(aws.ToString(obj.Key), prefix)] = true
+	}
+	return present, nil
+}
+
+// acceptableSource: ресайз без метаданных (старый) не берём — не знаем, не апскейл ли он.
+func acceptableSource(resize string, origW, origH int) bool {
+	if origW <= 0 || origH <= 0 {
+		return false
+	}
+	w, h, err := parseResize(resize)
+	if err != nil {
+		return false
+	}
+	return w <= origW && h <= origH
+}
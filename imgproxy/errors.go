@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type errKind int
+
+const (
+	errInternal errKind = iota
+	errBadRequest
+	errUnauthorized // нет учётных данных или они неверные: 401 + WWW-Authenticate
+	errForbidden
+	errNotFound
+	errUpstreamUnavailable // апстрим не ответил / 5xx
+	errUpstreamInvalid     // апстрим ответил мусором: не картинка, слишком большой, битые редиректы
+	errStorage             // S3/R2 или MySQL
+	errTimeout
+	errOverloaded
+	errTooManyRequests
+)
+
+func (k errKind) String() string {
+	switch k {
+	case errBadRequest:
+		return "bad_request"
+	case errUnauthorized:
+		return "unauthorized"
+	case errForbidden:
+		return "forbidden"
+	case errNotFound:
+		return "not_found"
+	case errUpstreamUnavailable:
+		return "upstream_unavailable"
+	case errUpstreamInvalid:
+		return "upstream_invalid"
+	case errStorage:
+		return "storage_failure"
+	case errTimeout:
+		return "timeout"
+	case errOverloaded:
+		return "overloaded"
+	case errTooManyRequests:
+		return "rate_limited"
+	default:
+		return "internal"
+	}
+}
+
+// Status — единственное место, где ошибка превращается в HTTP код.
+func (k errKind) Status() int {
+	switch k {
+	case errBadRequest:
+		return http.StatusBadRequest
+	case errUnauthorized:
+		return http.StatusUnauthorized
+	case errForbidden:
+		return http.StatusForbidden
+	case errNotFound:
+		return http.StatusNotFound
+	case errUpstreamUnavailable, errUpstreamInvalid:
+		return http.StatusBadGateway
+	case errStorage, errOverloaded:
+		return http.StatusServiceUnavailable
+	case errTimeout:
+		return http.StatusGatewayTimeout
+	case errTooManyRequests:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type appError struct {
+	kind errKind
+	msg  string // уходит клиенту
+	err  error  // причина, только в лог
+
+	retryAfter time.Duration // для 429/503
+}
+
+func (e *appError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("%s: %v", e.msg, e.err)
+	}
+	return e.msg
+}
+
+func (e *appError) Unwrap() error { return e.err }
+
+func newError(kind errKind, msg string, err error) *appError {
+	return &appError{kind: kind, msg: msg, err: err}
+}
+
+func errBadRequestf(format string, args ...any) error {
+	return newError(errBadRequest, fmt.Sprintf(format, args...), nil)
+}
+
+func errNotFoundf(format string, args ...any) error {
+	return newError(errNotFound, fmt.Sprintf(format, args...), nil)
+}
+
+func storageError(msg string, err error) error {
+	if k, ok := timeoutKind(err); ok {
+		return newError(k, msg, err)
+	}
+	return newError(errStorage, msg, err)
+}
+
+func upstreamError(msg string, err error) error {
+	if k, ok := timeoutKind(err); ok {
+		return newError(k, msg, err)
+	}
+	return newError(errUpstreamUnavailable, msg, err)
+}
+
+func upstreamInvalid(msg string, err error) error {
+	return newError(errUpstreamInvalid, msg, err)
+}
+
+func timeoutKind(err error) (errKind, bool) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errTimeout, true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return errTimeout, true
+	}
+	return 0, false
+}
+
+func errorKind(err error) errKind {
+	var ae *appError
+	if errors.As(err, &ae) {
+		return ae.kind
+	}
+	if k, ok := timeoutKind(err); ok {
+		return k
+	}
+	return errInternal
+}
+
+// errorCacheControl — политика кеширования ошибок по статусу.
+// 404 кешируем недолго (картинку могут добавить), 5xx не кешируем вовсе.
+func errorCacheControl(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return env("CACHE_CONTROL_400", "public, max-age=3600")
+	case http.StatusForbidden:
+		return env("CACHE_CONTROL_403", "no-store")
+	case http.StatusNotFound:
+		return env("CACHE_CONTROL_404", "public, max-age=300")
+	case http.StatusBadGateway:
+		return env("CACHE_CONTROL_502", "public, max-age=10")
+	case http.StatusServiceUnavailable:
+		return env("CACHE_CONTROL_503", "no-store")
+	case http.StatusGatewayTimeout:
+		return env("CACHE_CONTROL_504", "no-store")
+	case http.StatusTooManyRequests:
+		return "no-store"
+	default:
+		return "no-store"
+	}
+}
+
+type errorBody struct {
+	Error     string `json:"error"`
+	Message   string `json:"message"`
+	Status    int    `json:"status"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func (a *App) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	// клиент ушёл — отвечать некому
+	if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+		slog.InfoContext(r.Context(), "request canceled", "path", r.URL.Path, "err", err)
+		return
+	}
+
+	kind := errorKind(err)
+	status := kind.Status()
+	msg := http.StatusText(status)
+	var ae *appError
+	if errors.As(err, &ae) && ae.msg != "" {
+		msg = ae.msg
+	}
+	reqID := requestID(r.Context())
+	level := slog.LevelWarn
+	if status >= 500 {
+		level = slog.LevelError
+	}
+	slog.Log(r.Context(), level, "request failed", "status", status, "kind", kind.String(), "path", r.URL.Path, "err", err)
+
+	h := w.Header()
+	if ae != nil && ae.retryAfter > 0 {
+		h.Set("Retry-After", strconv.Itoa(int(math.Ceil(ae.retryAfter.Seconds()))))
+	}
+	h.Del("ETag")
+	h.Del("Content-Length")
+	h.Set("Cache-Control", errorCacheControl(status))
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	if a.errorJSON {
+		body, _ := json.Marshal(errorBody{Error: kind.String(), Message: msg, Status: status, RequestID: reqID})
+		h.Set("Content-Type", "application/json")
+		h.Set("Content-Length", strconv.Itoa(len(body)+1))
+		w.WriteHeader(status)
+		_, _ = w.Write(append(body, '\n'))
+		return
+	}
+
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintln(w, msg)
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"crypto/md5"
 	"encoding/hex"
-	"log"
 	"os"
 	"strconv"
 	"strings"
@@ -23,6 +22,11 @@ func md5hex(s string) string {
 	return hex.EncodeToString(sum[:])
 }
 
+func md5bytes(b []byte) string {
+	sum := md5.Sum(b)
+	return hex.EncodeToString(sum[:])
+}
+
 func originOf(u string) string {
 	// грубый парсер: scheme://host
 	// (достаточно для typical Location: /path)
@@ -36,6 +40,17 @@ func originOf(u string) string {
 	return u
 }
 
+// splitList разбирает "a, b,c" в []string без пустых элементов.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
 func env(k, def string) string {
 	v := os.Getenv(k)
 	if v == "" {
@@ -66,6 +81,18 @@ func envInt64(k string, def int64) int64 {
 	return n
 }
 
+func envFloat(k string, def float64) float64 {
+	v := os.Getenv(k)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return def
+	}
+	return f
+}
+
 func envBool(k string, def bool) bool {
 	v := strings.TrimSpace(strings.ToLower(os.Getenv(k)))
 	if v == "" {
@@ -81,21 +108,12 @@ func envBool(k string, def bool) bool {
 	}
 }
 
-func logLap(start time.Time, last *time.Time, msg string) {
-	if env("DEBUG_TIME_LOGGING", "0") != "1" {
-		return
-	}
-	now := time.Now()
-	total := now.Sub(start).Round(time.Millisecond)
-	if last == nil || last.IsZero() {
-		log.Printf("%s took %s (total %s)", msg, 0*time.Millisecond, total)
-		t := now
-		if last != nil {
-			*last = t
-		}
-		return
+// envBoolValue — тот же разбор для query-параметров.
+func envBoolValue(v string) bool {
+	switch strings.TrimSpace(strings.ToLower(v)) {
+	case "1", "true", "yes", "on":
+		return true
+	default:
+		return false
 	}
-	lap := now.Sub(*last).Round(time.Millisecond)
-	log.Printf("%s took +%s (total %s)", msg, lap, total)
-	*last = now
 }
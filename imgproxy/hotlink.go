@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type hotlinkPolicy struct {
+	defaults   []string
+	byType     map[string][]string
+	allowEmpty bool
+
+	placeholder   []byte
+	placeholderCT string
+}
+
+// loadHotlinkPolicy: HOTLINK_DOMAINS — для всех типов, HOTLINK_DOMAINS_<TYPE> — переопределение для типа.
+func loadHotlinkPolicy() (*hotlinkPolicy, error) {
+	if !envBool("HOTLINK_PROTECTION", false) {
+		return nil, nil
+	}
+	p := &hotlinkPolicy{
+		defaults:   splitList(env("HOTLINK_DOMAINS", "")),
+		byType:     map[string][]string{},
+		allowEmpty: envBool("HOTLINK_ALLOW_EMPTY", true),
+	}
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		if typ, ok := strings.CutPrefix(k, "HOTLINK_DOMAINS_"); ok && typ != "" {
+			p.byType[strings.ToLower(typ)] = splitList(v)
+		}
+	}
+	if f := env("HOTLINK_PLACEHOLDER_FILE", ""); f != "" {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("read HOTLINK_PLACEHOLDER_FILE: %w", err)
+		}
+		p.placeholder = b
+		p.placeholderCT = http.DetectContentType(b)
+	}
+	return p, nil
+}
+
+func (p *hotlinkPolicy) allowed(typ string, r *http.Request) bool {
+	patterns, ok := p.byType[strings.ToLower(typ)]
+	if !ok {
+		patterns = p.defaults
+	}
+	ref := r.Header.Get("Referer")
+	origin := r.Header.Get("Origin")
+	if ref == "" && (origin == "" || origin == "null") {
+		return p.allowEmpty
+	}
+	for _, v := range []string{origin, ref} {
+		if v == "" || v == "null" {
+			continue
+		}
+		if !hostMatchesAny(refererHost(v), patterns) {
+			return false
+		}
+	}
+	return true
+}
+
+func refererHost(v string) string {
+	u, err := url.Parse(v)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// hostMatchesAny: "example.com" — точно, "*.example.com" — только поддомены, "*" — всё.
+func hostMatchesAny(host string, patterns []string) bool {
+	if host == "" {
+		return false
+	}
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		switch {
+		case p == "*":
+			return true
+		case strings.HasPrefix(p, "*."):
+			if strings.HasSuffix(host, p[1:]) {
+				return true
+			}
+		case host == p:
+			return true
+		}
+	}
+	return false
+}
+
+// metricType — {type} из URL для метки метрики. Проверка идёт до подписи и до БД, так что сюда
+// попадает что угодно: неизвестное сворачиваем в other, иначе любой клиент плодит серии.
+func metricType(typ string) string {
+	switch typ {
+	case "videos", "actors", "directors", "screenshots":
+		return typ
+	default:
+		return "other"
+	}
+}
+
+// hotlinkGuard — чужие сайты не должны встраивать наши картинки за наш трафик.
+func (a *App) hotlinkGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.hotlink == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		typ := chi.URLParam(r, "type")
+		if a.hotlink.allowed(typ, r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		hotlinkBlocked.WithLabelValues(metricType(typ)).Inc()
+
+		if a.hotlink.placeholder == nil {
+			a.writeError(w, r, newError(errForbidden, "hotlinking not allowed", nil))
+			return
+		}
+		w.Header().Set("Content-Type", a.hotlink.placeholderCT)
+		w.Header().Set("Content-Length", strconv.Itoa(len(a.hotlink.placeholder)))
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-B-Source", "hotlink")
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			_, _ = w.Write(a.hotlink.placeholder)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHostMatchesAny(t *testing.T) {
+	patterns := []string{"flixhub.com", "*.Partner.org"}
+	for _, tc := range []struct {
+		host string
+		want bool
+	}{
+		{"flixhub.com", true},
+		{"www.flixhub.com", false},
+		{"cdn.partner.org", true},
+		{"a.b.partner.org", true},
+		{"partner.org", false},
+		{"evilpartner.org", false},
+		{"partner.org.evil.com", false},
+		{"flixhub.com.evil.com", false},
+		{"", false},
+	} {
+		if got := hostMatchesAny(tc.host, patterns); got != tc.want {
+			t.Errorf("hostMatchesAny(%q) = %v, want %v", tc.host, got, tc.want)
+		}
+	}
+	if !hostMatchesAny("anything.example", []string{"*"}) {
+		t.Error(`"*" must match any host`)
+	}
+	if hostMatchesAny("", []string{"*"}) {
+		t.Error("empty host must not match")
+	}
+	if hostMatchesAny("flixhub.com", nil) {
+		t.Error("no patterns must not match")
+	}
+}
+
+func TestHotlinkAllowed(t *testing.T) {
+	p := &hotlinkPolicy{
+		defaults:   []string{"flixhub.com", "*.flixhub.com"},
+		byType:     map[string][]string{"screenshots": {"*"}},
+		allowEmpty: true,
+	}
+	for _, tc := range []struct {
+		name    string
+		typ     string
+		referer string
+		origin  string
+		want    bool
+	}{
+		{"own site", "videos", "https://www.flixhub.com/film/1", "", true},
+		{"foreign site", "videos", "https://evil.com/page", "", false},
+		{"foreign origin, own referer", "videos", "https://flixhub.com/", "https://evil.com", false},
+		{"no referer", "videos", "", "", true},
+		{"null origin", "videos", "", "null", true},
+		{"type override", "screenshots", "https://evil.com/page", "", true},
+		{"type is case-insensitive", "Screenshots", "https://evil.com/page", "", true},
+		{"broken referer", "videos", "::not a url", "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/sss/"+tc.typ+"/1/abc", nil)
+			if tc.referer != "" {
+				r.Header.Set("Referer", tc.referer)
+			}
+			if tc.origin != "" {
+				r.Header.Set("Origin", tc.origin)
+			}
+			if got := p.allowed(tc.typ, r); got != tc.want {
+				t.Fatalf("allowed = %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	strict := &hotlinkPolicy{defaults: []string{"flixhub.com"}}
+	if strict.allowed("videos", httptest.NewRequest("GET", "/", nil)) {
+		t.Error("empty referer must be refused when allowEmpty is off")
+	}
+}
+
+func TestMetricType(t *testing.T) {
+	for in, want := range map[string]string{
+		"videos":      "videos",
+		"screenshots": "screenshots",
+		"Videos":      "other",
+		"random-123":  "other",
+		"":            "other",
+	} {
+		if got := metricType(in); got != want {
+			t.Errorf("metricType(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// jobQueue — фоновая догенерация ресайзов (пресеты после заливки оригинала, точные варианты после деградации).
+// Воркеры берут слот пула ресайза только когда живые запросы не ждут, т.е. приоритет у фона ниже.
+// Переживает рестарт только mysql; memory (по умолчанию) теряет задачи при выключении.
+type jobQueue interface {
+	enqueue(j variantJob) bool
+	run(ctx context.Context, workers int, handle func(context.Context, variantJob) error)
+	// flush при выключении дописывает в хранилище всё, что ещё не сохранено.
+	flush(ctx context.Context)
+}
+
+func newJobQueue(db *sql.DB) (jobQueue, error) {
+	switch kind := env("JOB_QUEUE", "memory"); kind {
+	case "memory":
+		return newMemoryQueue(int(envInt64("JOB_QUEUE_SIZE", 256))), nil
+	case "mysql":
+		q := &mysqlQueue{
+			db:          db,
+			table:       env("JOB_QUEUE_TABLE", "imgproxy_jobs"),
+			poll:        envDuration("JOB_QUEUE_POLL", 2*time.Second),
+			lease:       envDuration("JOB_QUEUE_LEASE", 5*time.Minute),
+			maxAttempts: int(envInt64("JOB_QUEUE_MAX_ATTEMPTS", 5)),
+			inbox:       make(chan variantJob, envInt64("JOB_QUEUE_SIZE", 256)),
+			writerDone:  make(chan struct{}),
+		}
+		if err := q.migrate(context.Background()); err != nil {
+			return nil, fmt.Errorf("job queue table: %w", err)
+		}
+		go q.writer()
+		return q, nil
+	default:
+		return nil, fmt.Errorf("bad JOB_QUEUE %q: want mysql or memory", kind)
+	}
+}
+
+func (a *App) runJobs(ctx context.Context) {
+	a.jobs.run(ctx, int(envInt64("JOB_WORKERS", 2)), func(ctx context.Context, j variantJob) error {
+		jctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+		defer cancel()
+		err := a.renderVariant(jctx, j)
+		if err != nil {
+			slog.WarnContext(ctx, "background job failed", "job", j.String(), "err", err)
+		} else {
+			slog.InfoContext(ctx, "background job ok", "job", j.String())
+		}
+		return err
+	})
+}
+
+// memoryQueue — без БД: дубликаты и переполнение отбрасываются, после рестарта всё теряется.
+// Не durable — для этого JOB_QUEUE=mysql.
+type memoryQueue struct {
+	ch      chan variantJob
+	mu      sync.Mutex
+	pending map[variantJob]bool
+}
+
+func newMemoryQueue(size int) *memoryQueue {
+	return &memoryQueue{ch: make(chan variantJob, size), pending: map[variantJob]bool{}}
+}
+
+func (q *memoryQueue) enqueue(j variantJob) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending[j] {
+		return false
+	}
+	select {
+	case q.ch <- j:
+		q.pending[j] = true
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *memoryQueue) run(ctx context.Context, workers int, handle func(context.Context, variantJob) error) {
+	var wg sync.WaitGroup
+	for i := 0; i < max(workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case j := <-q.ch:
+					_ = handle(ctx, j)
+					q.mu.Lock()
+					delete(q.pending, j)
+					q.mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// flush: хранилища нет, недоделанное теряется.
+func (q *memoryQueue) flush(context.Context) {
+	if n := len(q.ch); n > 0 {
+		slog.Warn("memory job queue dropped on shutdown", "jobs", n)
+	}
+}
+
+// mysqlQueue — задачи в таблице, переживают рестарт и делятся между подами.
+// Дедупликация — уникальный ключ, захват — аренда (locked_until) с владельцем.
+type mysqlQueue struct {
+	db          *sql.DB
+	table       string
+	poll        time.Duration
+	lease       time.Duration
+	maxAttempts int
+	inbox       chan variantJob // буфер перед INSERT: запрос не ждёт БД
+	writerDone  chan struct{}
+
+	mu     sync.Mutex // закрытие inbox против enqueue
+	closed bool
+}
+
+func (q *mysqlQueue) migrate(ctx context.Context) error {
+	_, err := q.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+q.table+` (
+  id bigint unsigned NOT NULL AUTO_INCREMENT,
+  type varchar(32) NOT NULL,
+  entity_id int NOT NULL,
+  hash char(32) NOT NULL,
+  variant varchar(16) NOT NULL DEFAULT '',
+  attempts int NOT NULL DEFAULT 0,
+  run_after datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  locked_until datetime NULL,
+  owner varchar(32) NULL,
+  last_error varchar(255) NULL,
+  created_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (id),
+  UNIQUE KEY uniq_job (type, entity_id, hash, variant),
+  KEY run_after (run_after)
+)`)
+	return err
+}
+
+// enqueue обычно в БД не ходит: задача кладётся в буфер, INSERT делает writer.
+// Буфер полон или очередь уже закрыта (выключение) — пишем сами, чтобы задача не потерялась.
+func (q *mysqlQueue) enqueue(j variantJob) bool {
+	q.mu.Lock()
+	if !q.closed {
+		select {
+		case q.inbox <- j:
+			q.mu.Unlock()
+			return true
+		default:
+		}
+	}
+	q.mu.Unlock()
+	return q.insert(j)
+}
+
+// writer переносит задачи из буфера в таблицу.
+func (q *mysqlQueue) writer() {
+	defer close(q.writerDone)
+	for j := range q.inbox {
+		q.insert(j)
+	}
+}
+
+// insert — дубликаты отсекает уникальный ключ.
+func (q *mysqlQueue) insert(j variantJob) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := q.db.ExecContext(ctx,
+		`INSERT IGNORE INTO `+q.table+` (type, entity_id, hash, variant) VALUES (?, ?, ?, ?)`,
+		j.typ, j.id, j.hash, j.resize)
+	if err != nil {
+		slog.Error("job enqueue failed", "job", j.String(), "err", err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+// flush закрывает буфер и ждёт, пока writer допишет его в таблицу.
+// Задачи, поставленные после этого, пишутся синхронно.
+func (q *mysqlQueue) flush(ctx context.Context) {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.inbox)
+	}
+	q.mu.Unlock()
+	select {
+	case <-q.writerDone:
+	case <-ctx.Done():
+		slog.Warn("job queue flush deadline reached", "unsaved", len(q.inbox))
+	}
+}
+
+func (q *mysqlQueue) run(ctx context.Context, workers int, handle func(context.Context, variantJob) error) {
+	var wg sync.WaitGroup
+	for i := 0; i < max(workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				j, jobID, err := q.claim(ctx)
+				if err != nil {
+					slog.Error("job claim failed", "err", err)
+				}
+				if err != nil || jobID == 0 {
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(q.poll):
+					}
+					continue
+				}
+				err = handle(ctx, j)
+				if ctx.Err() != nil {
+					// выключаемся: прерванная задача — не провал, отдаём её следующему воркеру без паузы
+					q.release(jobID, j)
+					return
+				}
+				q.complete(jobID, j, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// claim арендует одну готовую задачу. jobID == 0 — задач нет.
+// id захваченной строки возвращается через LAST_INSERT_ID(id), дальше читаем по первичному ключу:
+// индекса на owner нет.
+func (q *mysqlQueue) claim(ctx context.Context) (variantJob, int64, error) {
+	owner := newRequestID()
+	res, err := q.db.ExecContext(ctx,
+		`UPDATE `+q.table+` SET id = LAST_INSERT_ID(id), owner = ?, locked_until = NOW() + INTERVAL ? SECOND, attempts = attempts + 1
+		 WHERE run_after <= NOW() AND (locked_until IS NULL OR locked_until < NOW())
+		 ORDER BY id LIMIT 1`,
+		owner, int(q.lease/time.Second))
+	if err != nil {
+		return variantJob{}, 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return variantJob{}, 0, nil
+	}
+	jobID, err := res.LastInsertId()
+	if err != nil {
+		return variantJob{}, 0, err
+	}
+	var j variantJob
+	err = q.db.QueryRowContext(ctx,
+		`SELECT type, entity_id, hash, variant FROM `+q.table+` WHERE id = ? AND owner = ?`, jobID, owner,
+	).Scan(&j.typ, &j.id, &j.hash, &j.resize)
+	if err != nil {
+		return variantJob{}, 0, err
+	}
+	return j, jobID, nil
+}
+
+// release снимает аренду и возвращает попытку, потраченную на claim.
+func (q *mysqlQueue) release(jobID int64, j variantJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := q.db.ExecContext(ctx,
+		`UPDATE `+q.table+` SET owner = NULL, locked_until = NULL, attempts = GREATEST(attempts - 1, 0) WHERE id = ?`,
+		jobID); err != nil {
+		slog.Error("job release failed", "job", j.String(), "err", err)
+	}
+}
+
+// complete: успех — удаляем; ошибка — откладываем с экспоненциальной паузой, после maxAttempts — выбрасываем.
+func (q *mysqlQueue) complete(jobID int64, j variantJob, jobErr error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if jobErr == nil || errorKind(jobErr) == errNotFound {
+		if _, err := q.db.ExecContext(ctx, `DELETE FROM `+q.table+` WHERE id = ?`, jobID); err != nil {
+			slog.Error("job delete failed", "job", j.String(), "err", err)
+		}
+		return
+	}
+	msg := jobErr.Error()
+	if len(msg) > 255 {
+		msg = msg[:255]
+	}
+	_, err := q.db.ExecContext(ctx,
+		`UPDATE `+q.table+` SET owner = NULL, locked_until = NULL, last_error = ?,
+		   run_after = NOW() + INTERVAL LEAST(3600, 30 * POW(2, attempts - 1)) SECOND
+		 WHERE id = ? AND attempts < ?`,
+		msg, jobID, q.maxAttempts)
+	if err != nil {
+		slog.Error("job reschedule failed", "job", j.String(), "err", err)
+		return
+	}
+	if _, err := q.db.ExecContext(ctx,
+		`DELETE FROM `+q.table+` WHERE id = ? AND attempts >= ?`, jobID, q.maxAttempts); err != nil {
+		slog.Error("job drop failed", "job", j.String(), "err", err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"database/sql"
@@ -8,10 +9,14 @@ import (
 	"fmt"
 	"image"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/chai2010/webp"
@@ -19,25 +24,86 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func main() {
 
+	setupLogging()
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		slog.Error("startup failed", "err", err)
+		os.Exit(1)
+	}
+
 	app, err := newApp()
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("startup failed", "err", err)
+		os.Exit(1)
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	jobsDone := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			app.runJobs(jobsCtx)
+		}()
+		go func() {
+			defer wg.Done()
+			app.runChanges(jobsCtx)
+		}()
+		wg.Wait()
+		close(jobsDone)
+	}()
+
 	r := chi.NewRouter()
+	r.Use(withRequestID)
+	r.Use(withTracing)
+	r.Use(accessLog)
+	r.Use(withTrace)
 	r.Get("/readyz", app.Readyz)
 	r.Head("/readyz", app.Readyz)
 	r.Get("/healthz", app.Healthz)
 	r.Head("/healthz", app.Healthz)
-	r.Get("/sss/{type}/{id}/{md5}", app.handleSSS)
+	r.Handle("/metrics", promhttp.Handler())
+	if app.adminToken != "" {
+		r.Route("/admin", app.adminRoutes)
+	}
+	r.Group(func(r chi.Router) {
+		r.Use(withDeadline(envDuration("REQUEST_TIMEOUT", 0)))
+		r.Use(app.rateLimit)
+		r.Use(app.hotlinkGuard)
+		r.Use(app.requireSignature)
+		r.Get("/sss/{type}/{id}/{md5}", app.handleSSS)
+		r.Head("/sss/{type}/{id}/{md5}", app.handleSSS)
+	})
+
+	srv := newHTTPServer(env("LISTEN", ":80"), r)
+	go func() {
+		slog.Info("listening", "addr", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("listen failed", "err", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	app.shutdown(srv, stopJobs, jobsDone)
 
-	addr := env("LISTEN", ":80")
-	log.Printf("listening on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, r))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Warn("trace exporter shutdown", "err", err)
+	}
 }
 
 func (a *App) Healthz(w http.ResponseWriter, _ *http.Request) {
@@ -45,21 +111,16 @@ func (a *App) Healthz(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func (a *App) Readyz(w http.ResponseWriter, r *http.Request) {
-	// живой ли апп и готов ли к работе (БД, хранилище)
-	// ctx, cancel := context.WithTimeout(r.Context(), 500*time.Millisecond)
-	// defer cancel()
-	// if err := db.PingContext(ctx); err != nil {
-	// 	http.Error(w, "db not ready", 503)
-	// 	return
-	// }
-	w.WriteHeader(http.StatusOK)
+func (a *App) handleSSS(w http.ResponseWriter, r *http.Request) {
+	if err := a.serveSSS(w, r); err != nil {
+		a.writeError(w, r, err)
+	}
 }
 
-func (a *App) handleSSS(w http.ResponseWriter, r *http.Request) {
+// serveSSS возвращает ошибку только пока ответ ещё не начат;
+// после отправки заголовков ошибки только логируются.
+func (a *App) serveSSS(w http.ResponseWriter, r *http.Request) error {
 	startTime := time.Now()
-	var startTimeLap time.Time
-	logLap(startTime, &startTimeLap, "start")
 
 	typ := chi.URLParam(r, "type")
 	idStr := chi.URLParam(r, "id")
@@ -67,8 +128,7 @@ func (a *App) handleSSS(w http.ResponseWriter, r *http.Request) {
 
 	id, err := strconv.Atoi(idStr)
 	if err != nil || id <= 0 {
-		http.Error(w, "bad id", 400)
-		return
+		return errBadRequestf("bad id")
 	}
 
 	md5clean := md5raw
@@ -80,111 +140,219 @@ func (a *App) handleSSS(w http.ResponseWriter, r *http.Request) {
 	}
 
 	hash, resize := splitHashResize(md5clean)
+	if resize != "" {
+		if _, _, err := parseResize(resize); err != nil {
+			return err
+		}
+	}
+
+	origKey := a.objectKey(typ, id, hash)
+	fullKey := a.objectKey(typ, id, md5clean)
 
-	origKey := fmt.Sprintf("%s/%s/%d/%s", a.prefix, typ, id, hash)
-	fullKey := fmt.Sprintf("%s/%s/%d/%s", a.prefix, typ, id, md5clean)
+	slog.DebugContext(r.Context(), "get", "key", fullKey)
 
-	log.Printf("GET: %s", fullKey)
+	if resize == "" {
+		return a.serveOriginal(w, r, typ, id, hash, origKey, startTime)
+	}
 
 	// try resized in storage first (optimization)
 	served, err := a.serveFromS3IfPresent(w, r, fullKey, "resized-cache", startTime)
-	logLap(startTime, &startTimeLap, "s3 get resized")
 	if err != nil {
-		log.Println("s3 serve resized error:", err)
 		// если served=true, ответ мог уже частично уйти; безопаснее просто выйти
 		if served {
-			return
+			slog.ErrorContext(r.Context(), "s3 serve resized failed", "err", err)
+			return nil
 		}
-		http.Error(w, "storage error", 424)
-		return
+		return storageError("storage error", err)
 	}
 	if served {
-		return
+		return nil
+	}
+	if err := a.takeMissBudget(r); err != nil {
+		return err
+	}
+	if r.Method == http.MethodHead {
+		return a.headMiss(w, r, typ, id, hash, resize, startTime)
+	}
+	if a.shouldDegrade(r.Context()) && a.serveNearestVariant(w, r, typ, id, hash, resize, startTime) {
+		return nil
 	}
 
-	// try original in storage
-	origBody, origCT, _, ok, err := a.getObject(r.Context(), origKey)
-	logLap(startTime, &startTimeLap, "s3 get orig")
+	// 3) resize: из готового крупного ресайза, из оригинала в S3 или из апстрима
+	src, err := a.openVariantSource(r.Context(), typ, id, hash, resize)
 	if err != nil {
-		log.Println("error s3 get orig", err)
-		http.Error(w, "storage error", 424)
-		return
+		return err
 	}
+	defer src.Close()
 
-	var data []byte
-	var contentType string
-	var source string
-	var responseCode = 200
-
-	if ok {
-		log.Println("s3 get orig ok")
-		data = origBody
-		contentType = origCT
-		source = "orig-cache"
-	} else {
-		log.Println("s3 get orig 404")
-		// 2) resolve remote url via DB
-		remoteURL, err := a.remoteURLFromDB(r.Context(), typ, id, hash)
-		logLap(startTime, &startTimeLap, "db get remote url")
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				log.Println("db - not found hash", hash)
-				http.Error(w, "not found", 404)
-				return
-			}
-			log.Println("db error", err)
-			http.Error(w, "db error", 424)
-			return
+	doneQueue := stage(r.Context(), "queue")
+	release, err := a.resizePool.acquire(r.Context())
+	doneQueue()
+	if err != nil {
+		// оригинал уже скачан — сохраним, в следующий раз не придётся качать
+		src.finish(r.Context(), true)
+		if errorKind(err) == errOverloaded && a.serveNearestVariant(w, r, typ, id, hash, resize, startTime) {
+			return nil
 		}
+		return err
+	}
+	slog.DebugContext(r.Context(), "resizing", "resize", resize, "from", src.label)
+	resized, size, err := resizeToWebP(r.Context(), src.rd, resize)
+	release()
+	src.finish(r.Context(), err == nil)
+	if err != nil {
+		return err
+	}
+	source := src.label
+
+	ct := "image/webp"
+	localEtag := md5bytes(resized)
+	// upload resized - асинхронно
+	doneUpload := stage(r.Context(), "upload")
+	a.uploadAsync(r.Context(), fullKey, ct, spoolBytes(resized), src.lineageMeta(size))
+	doneUpload()
+
+	// ETag тот же, что потом отдаст кеш, поэтому 304 возможен и на свежей генерации
+	if notModified(r, localEtag, time.Time{}) {
+		writeNotModified(w, r, ct, localEtag, time.Time{}, "resized-"+source, time.Since(startTime))
+		return nil
+	}
 
-		body, ct, code, err := a.fetchRemoteWithRedirects(r.Context(), remoteURL)
-		logLap(startTime, &startTimeLap, "fetch orig url")
-		if err != nil {
-			log.Println("fetch error", remoteURL, err)
-			return
-		}
-		if code == 404 {
-			// твоя логика: "заглушка" с 404
-			log.Println("fetch 404", remoteURL, err)
-			http.Error(w, "not found", 404)
-			return
+	writeCommon(w, r, ct, localEtag, "resized-"+source, time.Since(startTime))
+	w.Header().Set("Content-Length", strconv.Itoa(len(resized)))
+	w.WriteHeader(src.code)
+	_, _ = w.Write(resized)
+	return nil
+}
+
+// serveOriginal отдаёт оригинал без ресайза: из S3 или с апстрима; мелкие (до SPOOL_MEM_BYTES)
+// сначала дочитываются в спул ради ETag, остальное стримится без буферизации в память.
+func (a *App) serveOriginal(w http.ResponseWriter, r *http.Request, typ string, id int, hash, origKey string, startTime time.Time) error {
+	served, err := a.serveFromS3IfPresent(w, r, origKey, "orig-cache", startTime)
+	if err != nil {
+		if served {
+			slog.ErrorContext(r.Context(), "s3 serve orig failed", "err", err)
+			return nil
 		}
-		responseCode = code
+		return storageError("storage error", err)
+	}
+	if served {
+		return nil
+	}
+	if err := a.takeMissBudget(r); err != nil {
+		return err
+	}
+	if r.Method == http.MethodHead {
+		return a.headMiss(w, r, typ, id, hash, "", startTime)
+	}
+	slog.DebugContext(r.Context(), "orig not in storage, fetching upstream", "key", origKey)
 
-		data = body
-		contentType = ct
-		source = "remote"
+	// апстрим качаем не на контексте запроса: если клиент отвалится, оригинал докачается в спул
+	// и всё равно попадёт в S3. Сверху время ограничено таймаутом http-клиента (HTTP_TIMEOUT).
+	remote, err := a.openRemoteOriginal(context.WithoutCancel(r.Context()), typ, id, hash)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
 
-		// upload original - асинхронно
-		a.uploadAsync(origKey, contentType, data)
+	if remote.size >= 0 && remote.size <= a.spoolMem {
+		return a.serveSmallRemote(w, r, remote, origKey, typ, id, hash, startTime)
 	}
 
-	// 3) resize if requested
-	if resize != "" {
-		log.Printf("resizing to %s", resize)
-		resized, err := resizeToWebP(data, resize)
-		logLap(startTime, &startTimeLap, "resize to webp")
+	// большой или неизвестной длины оригинал стримим как есть: ETag (md5 тела) до конца стрима
+	// неизвестен, со следующего запроса отдадим из кеша с ETag
+	writeCommon(w, r, remote.contentType, "", "orig-remote", time.Since(startTime))
+	if remote.size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(remote.size, 10))
+	}
+	w.WriteHeader(remote.code)
+
+	sp := a.newSpool()
+	if _, err := io.Copy(w, io.TeeReader(remote, sp)); err != nil && remote.err == nil {
+		// клиент отвалился — докачиваем в спул, оригинал всё равно пригодится
+		_, _ = io.Copy(sp, remote)
+	}
+	if remote.err != nil {
+		// заголовки уже ушли: обычный return закончил бы chunked-ответ штатно, и клиент с CDN
+		// сохранили бы обрезанную картинку на год. Рвём соединение.
+		slog.WarnContext(r.Context(), "upstream stream failed, aborting response", "err", remote.err)
+		sp.Close()
+		panic(http.ErrAbortHandler)
+	}
+
+	// upload original - асинхронно
+	defer stage(r.Context(), "upload")()
+	a.uploadIngest(r.Context(), origKey, remote.contentType, sp, typ, id, hash)
+	return nil
+}
+
+// serveSmallRemote — оригинал, который целиком влезает в SPOOL_MEM_BYTES, сначала дочитываем
+// в спул: так есть md5-ETag уже в первом ответе, работают 304, а обрыв апстрима превращается
+// в нормальную ошибку до отправки заголовков.
+func (a *App) serveSmallRemote(w http.ResponseWriter, r *http.Request, remote *remoteBody, origKey, typ string, id int, hash string, startTime time.Time) error {
+	sp := a.newSpool()
+	if _, err := io.Copy(sp, remote); err != nil {
+		sp.Close()
+		if remote.err != nil {
+			return remote.err
+		}
+		return storageError("spool error", err)
+	}
+	etag := sp.MD5()
+
+	if notModified(r, etag, time.Time{}) {
+		writeNotModified(w, r, remote.contentType, etag, time.Time{}, "orig-remote", time.Since(startTime))
+	} else {
+		body, err := sp.Reader()
 		if err != nil {
-			log.Println("resize error", err)
-			http.Error(w, "resize error", 400)
-			return
+			sp.Close()
+			return storageError("spool error", err)
 		}
+		writeCommon(w, r, remote.contentType, etag, "orig-remote", time.Since(startTime))
+		w.Header().Set("Content-Length", strconv.FormatInt(sp.Size(), 10))
+		w.WriteHeader(remote.code)
+		_, _ = io.Copy(w, body)
+	}
 
-		ct := "image/webp"
-		// upload resized - асинхронно. etag пустой при этом но сгенерится при повторном запросе
-		a.uploadAsync(fullKey, ct, resized)
+	// upload original - асинхронно
+	defer stage(r.Context(), "upload")()
+	a.uploadIngest(r.Context(), origKey, remote.contentType, sp, typ, id, hash)
+	return nil
+}
 
-		localEtag := md5hex(string(resized))
-		writeCommon(w, r, ct, localEtag, "resized-"+source, time.Since(startTime))
-		w.WriteHeader(responseCode)
-		_, _ = w.Write(resized)
-		return
+// headMiss — HEAD для того, чего ещё нет в кеше: ничего не качаем и не генерируем,
+// только проверяем по БД, что такая картинка вообще есть.
+func (a *App) headMiss(w http.ResponseWriter, r *http.Request, typ string, id int, hash, resize string, startTime time.Time) error {
+	if _, err := a.remoteURLFromDB(r.Context(), typ, id, hash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errNotFoundf("not found")
+		}
+		return storageError("db error", err)
 	}
+	if resize != "" {
+		w.Header().Set("Content-Type", "image/webp")
+	}
+	// длины и ETag ещё нет — не даём CDN закешировать такой ответ надолго
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-B-Source", "head-miss")
+	w.Header().Set("X-Req-Ms", fmt.Sprintf("%.2f", float64(time.Since(startTime).Microseconds())/1000.0))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
 
-	logLap(startTime, &startTimeLap, "total http process")
-	writeCommon(w, r, contentType, md5hex(string(data)), "orig-"+source, time.Since(startTime))
-	w.WriteHeader(responseCode)
-	_, _ = w.Write(data)
+// openRemoteOriginal находит URL в БД и открывает его у апстрима.
+func (a *App) openRemoteOriginal(ctx context.Context, typ string, id int, hash string) (*remoteBody, error) {
+	doneResolve := stage(ctx, "resolve")
+	remoteURL, err := a.remoteURLFromDB(ctx, typ, id, hash)
+	doneResolve()
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errNotFoundf("not found")
+		}
+		return nil, storageError("db error", err)
+	}
+	defer stage(ctx, "fetch")()
+	return a.fetchOriginal(ctx, remoteURL)
 }
 
 func (a *App) remoteURLFromDB(ctx context.Context, typ string, id int, wantHash string) (string, error) {
@@ -192,9 +360,10 @@ func (a *App) remoteURLFromDB(ctx context.Context, typ string, id int, wantHash
 	switch typ {
 	case "videos":
 		var img, backdrop sql.NullString
-		err := a.db.QueryRowContext(ctx,
-			`SELECT img, backdrop FROM videos WHERE id = ? LIMIT 1`, id,
-		).Scan(&img, &backdrop)
+		err := a.reads.queryRow(ctx,
+			`SELECT img, backdrop FROM videos WHERE id = ? LIMIT 1`,
+			[]any{id}, &img, &backdrop,
+		)
 		if err != nil {
 			return "", err
 		}
@@ -208,9 +377,10 @@ func (a *App) remoteURLFromDB(ctx context.Context, typ string, id int, wantHash
 
 	case "actors":
 		var poster sql.NullString
-		err := a.db.QueryRowContext(ctx,
-			`SELECT poster_url FROM actors WHERE id = ? LIMIT 1`, id,
-		).Scan(&poster)
+		err := a.reads.queryRow(ctx,
+			`SELECT poster_url FROM actors WHERE id = ? LIMIT 1`,
+			[]any{id}, &poster,
+		)
 		if err != nil {
 			return "", err
 		}
@@ -221,9 +391,10 @@ func (a *App) remoteURLFromDB(ctx context.Context, typ string, id int, wantHash
 
 	case "directors":
 		var poster sql.NullString
-		err := a.db.QueryRowContext(ctx,
-			`SELECT poster_url FROM directors WHERE id = ? LIMIT 1`, id,
-		).Scan(&poster)
+		err := a.reads.queryRow(ctx,
+			`SELECT poster_url FROM directors WHERE id = ? LIMIT 1`,
+			[]any{id}, &poster,
+		)
 		if err != nil {
 			return "", err
 		}
@@ -234,9 +405,10 @@ func (a *App) remoteURLFromDB(ctx context.Context, typ string, id int, wantHash
 
 	case "screenshots":
 		var u sql.NullString
-		err := a.db.QueryRowContext(ctx,
-			`SELECT url FROM screenshots WHERE id = ? LIMIT 1`, id,
-		).Scan(&u)
+		err := a.reads.queryRow(ctx,
+			`SELECT url FROM screenshots WHERE id = ? LIMIT 1`,
+			[]any{id}, &u,
+		)
 		if err != nil {
 			return "", err
 		}
@@ -250,13 +422,44 @@ func (a *App) remoteURLFromDB(ctx context.Context, typ string, id int, wantHash
 	}
 }
 
-func (a *App) fetchRemoteWithRedirects(ctx context.Context, startURL string) ([]byte, string, int, error) {
+// remoteBody — открытый ответ апстрима. Читать не больше maxFetch байт, потом — ошибка.
+type remoteBody struct {
+	rd          io.Reader
+	body        io.Closer
+	contentType string
+	size        int64 // -1 если апстрим не прислал Content-Length
+	code        int
+
+	n, max int64
+	err    error // первая ошибка чтения (не EOF)
+}
+
+func (b *remoteBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.rd.Read(p)
+	b.n += int64(n)
+	if b.n > b.max {
+		err = upstreamInvalid("upstream image too large", fmt.Errorf("remote too large"))
+	} else if err != nil && err != io.EOF {
+		err = upstreamError("upstream read failed", err)
+	}
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *remoteBody) Close() error { return b.body.Close() }
+
+func (a *App) fetchRemoteWithRedirects(ctx context.Context, startURL string) (*remoteBody, error) {
 	cur := startURL
 
 	for i := 0; i <= a.maxRedir; i++ {
 		req, err := http.NewRequestWithContext(ctx, "GET", cur, nil)
 		if err != nil {
-			return nil, "", 0, err
+			return nil, upstreamInvalid("bad upstream url", err)
 		}
 
 		// ВАЖНО: не следуем редиректам автоматически — хотим видеть Location
@@ -265,9 +468,24 @@ func (a *App) fetchRemoteWithRedirects(ctx context.Context, startURL string) ([]
 			return http.ErrUseLastResponse
 		}
 
+		host := upstreamHost(cur)
+		if err := a.breaker.allow(host, time.Now()); err != nil {
+			return nil, err
+		}
+		_, hop := startSpan(ctx, "upstream.fetch", attribute.String("server.address", host), attribute.Int("redirect.hop", i))
 		resp, err := client.Do(req)
+		if err == nil {
+			hop.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		}
+		endSpan(hop, err)
+		// отказы самого апстрима (сеть, 5xx, 429) открывают breaker; отмена клиентом — не отказ
+		if ctx.Err() != nil {
+			a.breaker.release(host)
+		} else {
+			a.breaker.record(host, err == nil && resp.StatusCode < 500 && resp.StatusCode != 429, time.Now())
+		}
 		if err != nil {
-			return nil, "", 0, err
+			return nil, upstreamError("upstream unavailable", err)
 		}
 
 		// 3xx redirect
@@ -276,10 +494,10 @@ func (a *App) fetchRemoteWithRedirects(ctx context.Context, startURL string) ([]
 			resp.Body.Close()
 
 			if strings.Contains(loc, "no-poster.gif") {
-				return nil, "", 404, nil
+				return nil, errNotFoundf("not found")
 			}
 			if loc == "" {
-				return nil, "", 0, fmt.Errorf("redirect without location")
+				return nil, upstreamInvalid("bad upstream redirect", fmt.Errorf("redirect without location"))
 			}
 			// relative -> absolute
 			next := loc
@@ -293,73 +511,123 @@ func (a *App) fetchRemoteWithRedirects(ctx context.Context, startURL string) ([]
 
 		if resp.StatusCode >= 400 {
 			resp.Body.Close()
-			if resp.StatusCode == 404 {
-				return nil, "", 404, nil
+			switch {
+			case resp.StatusCode == 404 || resp.StatusCode == 410:
+				return nil, errNotFoundf("not found")
+			case resp.StatusCode >= 500 || resp.StatusCode == 429:
+				return nil, upstreamError("upstream unavailable", fmt.Errorf("upstream status %d", resp.StatusCode))
+			default:
+				return nil, upstreamInvalid("upstream rejected request", fmt.Errorf("upstream status %d", resp.StatusCode))
 			}
-			return nil, "", resp.StatusCode, nil
 		}
 
-		limited := io.LimitReader(resp.Body, a.maxFetch+1)
-		b, err := io.ReadAll(limited)
-		resp.Body.Close()
-		if err != nil {
-			return nil, "", 0, err
-		}
-		if int64(len(b)) > a.maxFetch {
-			return nil, "", 0, fmt.Errorf("remote too large")
+		if resp.ContentLength > a.maxFetch {
+			resp.Body.Close()
+			return nil, upstreamInvalid("upstream image too large", fmt.Errorf("remote too large: %d", resp.ContentLength))
 		}
 
+		br := bufio.NewReader(io.LimitReader(resp.Body, a.maxFetch+1))
 		ct := resp.Header.Get("Content-Type")
 		if ct == "" {
-			ct = http.DetectContentType(b)
+			head, _ := br.Peek(512)
+			ct = http.DetectContentType(head)
 		}
 		if j := strings.Index(ct, ";"); j >= 0 {
 			ct = strings.TrimSpace(ct[:j])
 		}
-		return b, ct, resp.StatusCode, nil
+		return &remoteBody{
+			rd:          br,
+			body:        resp.Body,
+			contentType: ct,
+			size:        resp.ContentLength,
+			code:        resp.StatusCode,
+			max:         a.maxFetch,
+		}, nil
 	}
 
-	return nil, "", 0, fmt.Errorf("too many redirects")
+	return nil, upstreamInvalid("too many upstream redirects", fmt.Errorf("too many redirects"))
 }
 
-func resizeToWebP(input []byte, resize string) ([]byte, error) {
-	w, h := 0, 0
+// parseResize разбирает "600" (ширина) или "h600" (высота).
+func parseResize(resize string) (w, h int, err error) {
 	if strings.HasPrefix(resize, "h") {
 		v, err := strconv.Atoi(strings.TrimPrefix(resize, "h"))
 		if err != nil || v <= 0 {
-			return nil, fmt.Errorf("bad resize")
+			return 0, 0, errBadRequestf("bad resize")
 		}
 		if v%100 != 0 {
-			return nil, fmt.Errorf("bad resize: height must be multiple of 100")
+			return 0, 0, errBadRequestf("bad resize: height must be multiple of 100")
 		}
 		h = v
 	} else {
 		v, err := strconv.Atoi(resize)
 		if err != nil || v <= 0 {
-			return nil, fmt.Errorf("bad resize")
+			return 0, 0, errBadRequestf("bad resize")
 		}
 		if v%100 != 0 {
-			return nil, fmt.Errorf("bad resize: width must be multiple of 100")
+			return 0, 0, errBadRequestf("bad resize: width must be multiple of 100")
 		}
 		w = v
 	}
 	if w > 1000 || h > 1000 {
-		return nil, fmt.Errorf("too big")
+		return 0, 0, errBadRequestf("too big")
 	}
+	return w, h, nil
+}
+
+// resizeToWebP декодирует прямо из потока — весь оригинал в []byte не держим.
+// Вторым значением отдаёт размер исходника.
+func resizeToWebP(ctx context.Context, src io.Reader, resize string) ([]byte, image.Point, error) {
+	if _, _, err := parseResize(resize); err != nil {
+		return nil, image.Point{}, err
+	}
+	doneDecode := stage(ctx, "decode")
+	_, span := startSpan(ctx, "image.decode")
+	img, err := decodeImage(src)
+	endSpan(span, err)
+	doneDecode()
+	if err != nil {
+		return nil, image.Point{}, err
+	}
+	out, err := encodeResized(ctx, img, resize)
+	return out, img.Bounds().Size(), err
+}
+
+func decodeImage(src io.Reader) (image.Image, error) {
+	img, _, err := image.Decode(bufio.NewReader(src))
+	if err != nil {
+		var ae *appError
+		if errors.As(err, &ae) {
+			return nil, err
+		}
+		return nil, upstreamInvalid("source is not a decodable image", err)
+	}
+	return img, nil
+}
 
-	img, _, err := image.Decode(bytes.NewReader(input))
+func encodeResized(ctx context.Context, img image.Image, resize string) ([]byte, error) {
+	w, h, err := parseResize(resize)
 	if err != nil {
 		return nil, err
 	}
 
 	// preserve aspect ratio if one side is 0
+	doneResize := stage(ctx, "resize")
+	_, span := startSpan(ctx, "image.resize", attribute.String("resize", resize))
 	outImg := imaging.Resize(img, w, h, imaging.Lanczos)
+	span.End()
+	doneResize()
 
+	defer stage(ctx, "encode")()
+	_, span = startSpan(ctx, "image.encode", attribute.String("format", "webp"))
 	var buf bytes.Buffer
 	// quality 80 примерно как у тебя
 	if err := webp.Encode(&buf, outImg, &webp.Options{Quality: 80}); err != nil {
+		err = fmt.Errorf("webp encode: %w", err)
+		endSpan(span, err)
 		return nil, err
 	}
+	span.End()
 	return buf.Bytes(), nil
 }
 
@@ -369,6 +637,6 @@ func writeCommon(w http.ResponseWriter, r *http.Request, ct, etag, source string
 	w.Header().Set("X-B-Source", source)
 	w.Header().Set("X-Req-Ms", fmt.Sprintf("%.2f", float64(dur.Microseconds())/1000.0))
 	if etag != "" {
-		w.Header().Set("ETag", etag)
+		w.Header().Set("ETag", `"`+etag+`"`)
 	}
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	hotlinkBlocked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgproxy_hotlink_blocked_total",
+		Help: "Requests blocked by hotlink protection.",
+	}, []string{"type"})
+
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgproxy_rate_limited_total",
+		Help: "Requests rejected with 429, by budget (requests, misses).",
+	}, []string{"budget"})
+
+	poolBusy = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "imgproxy_resize_workers_busy",
+		Help: "Resize workers currently decoding, resizing or encoding.",
+	})
+	poolQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "imgproxy_resize_queue_depth",
+		Help: "Requests waiting for a free resize worker.",
+	})
+	poolWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "imgproxy_resize_queue_wait_seconds",
+		Help:    "Time spent waiting for a resize worker.",
+		Buckets: []float64{0, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	})
+	poolRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgproxy_resize_rejected_total",
+		Help: "Resize requests rejected with 503, by reason (queue_full, timeout).",
+	}, []string{"reason"})
+
+	degradedServed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgproxy_degraded_total",
+		Help: "Responses served from the nearest existing variant instead of the exact one.",
+	}, []string{"variant"})
+
+	uploadQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "imgproxy_upload_queue_depth",
+		Help: "Uploads to storage waiting in the in-memory queue.",
+	})
+	uploadRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "imgproxy_upload_retries_total",
+		Help: "Failed upload attempts that were retried.",
+	})
+	uploadFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "imgproxy_upload_failures_total",
+		Help: "Uploads dropped after exhausting retries or failing to persist.",
+	})
+	uploadSpilled = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "imgproxy_upload_spilled_total",
+		Help: "Uploads persisted to local disk because the queue was full or shutting down.",
+	})
+
+	upstreamBreakerOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "imgproxy_upstream_breaker_open",
+		Help: "1 while the circuit breaker for an upstream host is open.",
+	}, []string{"host"})
+
+	storageCapability = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "imgproxy_storage_capability",
+		Help: "1 if the storage operation (get, put, head, delete, list) passed the last probe.",
+	}, []string{"op"})
+
+	mysqlReplicaHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "imgproxy_mysql_replica_healthy",
+		Help: "1 while the MySQL read replica passes health checks.",
+	}, []string{"replica"})
+	mysqlReplicaFailover = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "imgproxy_mysql_replica_failover_total",
+		Help: "Reads retried on the primary after a replica failed.",
+	})
+
+	purgedObjects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "imgproxy_purged_objects_total",
+		Help: "Objects deleted from storage by purge.",
+	})
+
+	changesApplied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgproxy_changes_applied_total",
+		Help: "URL change feed entries processed, by result (ok, error).",
+	}, []string{"result"})
+)
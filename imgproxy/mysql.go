@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// readReplicas — реплики для чтения (резолвер URL). Запросы раскидываются по здоровым репликам
+// по кругу; упавшая реплика выбывает до следующей успешной проверки, когда живых нет — читаем с primary.
+type readReplicas struct {
+	primary  *sql.DB
+	replicas []*replica
+	next     atomic.Uint64
+}
+
+type replica struct {
+	name    string // host:port, для логов
+	db      *sql.DB
+	healthy atomic.Bool
+}
+
+// secretValue — значение из env или из файла NAME_FILE (env важнее).
+func secretValue(name string) (string, error) {
+	if v := env(name, ""); v != "" {
+		return v, nil
+	}
+	path := env(name+"_FILE", "")
+	if path == "" {
+		return "", nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%s_FILE: %w", name, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// mysqlDSN подставляет MYSQL_PASSWORD(_FILE), если в самом DSN пароля нет.
+func mysqlDSN(dsn, password string) (string, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Passwd == "" && password != "" {
+		cfg.Passwd = password
+	}
+	return cfg.FormatDSN(), nil
+}
+
+func openMySQL(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(int(envInt64("MYSQL_MAX_OPEN_CONNS", 20)))
+	db.SetMaxIdleConns(int(envInt64("MYSQL_MAX_IDLE_CONNS", 10)))
+	db.SetConnMaxLifetime(envDuration("MYSQL_CONN_MAX_LIFETIME", 30*time.Minute))
+	db.SetConnMaxIdleTime(envDuration("MYSQL_CONN_MAX_IDLE_TIME", 0))
+	return db, nil
+}
+
+func loadMySQL() (*sql.DB, *readReplicas, error) {
+	dsn, err := secretValue("MYSQL_DSN")
+	if err != nil {
+		return nil, nil, err
+	}
+	if dsn == "" {
+		return nil, nil, errors.New("missing MYSQL_DSN or MYSQL_DSN_FILE")
+	}
+	password, err := secretValue("MYSQL_PASSWORD")
+	if err != nil {
+		return nil, nil, err
+	}
+	if dsn, err = mysqlDSN(dsn, password); err != nil {
+		return nil, nil, fmt.Errorf("bad MYSQL_DSN: %w", err)
+	}
+	db, err := openMySQL(dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, nil, fmt.Errorf("mysql ping: %w", err)
+	}
+
+	rr := &readReplicas{primary: db}
+	replicaDSNs, err := secretValue("MYSQL_REPLICA_DSNS")
+	if err != nil {
+		return nil, nil, err
+	}
+	// DSN сам может содержать запятые (?charset=utf8mb4,utf8), поэтому делим только по строкам и ';'
+	for _, rdsn := range strings.FieldsFunc(replicaDSNs, func(r rune) bool { return r == '\n' || r == ';' }) {
+		rdsn = strings.TrimSpace(rdsn)
+		if rdsn == "" {
+			continue
+		}
+		cfg, err := mysql.ParseDSN(rdsn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad MYSQL_REPLICA_DSNS entry: %w", err)
+		}
+		if cfg.Passwd == "" {
+			cfg.Passwd = password
+		}
+		rdb, err := openMySQL(cfg.FormatDSN())
+		if err != nil {
+			return nil, nil, err
+		}
+		rep := &replica{name: cfg.Addr, db: rdb}
+		// недоступная при старте реплика не мешает запуску: проверка её вернёт, когда оживёт
+		if err := rdb.Ping(); err != nil {
+			slog.Warn("mysql replica is down", "replica", rep.name, "err", err)
+		} else {
+			rep.healthy.Store(true)
+		}
+		mysqlReplicaHealthy.WithLabelValues(rep.name).Set(boolGauge(rep.healthy.Load()))
+		rr.replicas = append(rr.replicas, rep)
+	}
+	if len(rr.replicas) > 0 {
+		go rr.watch(envDuration("MYSQL_REPLICA_CHECK_INTERVAL", 5*time.Second))
+	}
+	return db, rr, nil
+}
+
+func (rr *readReplicas) watch(every time.Duration) {
+	for range time.Tick(every) {
+		for _, rep := range rr.replicas {
+			ctx, cancel := context.WithTimeout(context.Background(), every)
+			err := rep.db.PingContext(ctx)
+			cancel()
+			rr.mark(rep, err == nil, err)
+		}
+	}
+}
+
+func (rr *readReplicas) mark(rep *replica, ok bool, err error) {
+	if rep.healthy.Swap(ok) != ok {
+		if ok {
+			slog.Info("mysql replica is back", "replica", rep.name)
+		} else {
+			slog.Warn("mysql replica is down", "replica", rep.name, "err", err)
+		}
+	}
+	mysqlReplicaHealthy.WithLabelValues(rep.name).Set(boolGauge(ok))
+}
+
+// pick — следующая здоровая реплика или nil.
+func (rr *readReplicas) pick() *replica {
+	n := len(rr.replicas)
+	start := rr.next.Add(1)
+	for i := 0; i < n; i++ {
+		rep := rr.replicas[(start+uint64(i))%uint64(n)]
+		if rep.healthy.Load() {
+			return rep
+		}
+	}
+	return nil
+}
+
+// queryRow — чтение одной строки с реплики; при сбое реплики (не при ErrNoRows) — повтор на primary.
+func (rr *readReplicas) queryRow(ctx context.Context, query string, args []any, dest ...any) error {
+	if rep := rr.pick(); rep != nil {
+		err := tracedQueryRow(ctx, rep.db, rep.name, query, args, dest)
+		if err == nil || errors.Is(err, sql.ErrNoRows) || ctx.Err() != nil {
+			return err
+		}
+		rr.mark(rep, false, err)
+		mysqlReplicaFailover.Inc()
+	}
+	return tracedQueryRow(ctx, rr.primary, "primary", query, args, dest)
+}
+
+func tracedQueryRow(ctx context.Context, db *sql.DB, target, query string, args, dest []any) error {
+	ctx, span := tracer.Start(ctx, "mysql.query", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.system", "mysql"),
+		attribute.String("db.query.text", query),
+		attribute.String("db.target", target),
+	))
+	err := db.QueryRowContext(ctx, query, args...).Scan(dest...)
+	if errors.Is(err, sql.ErrNoRows) {
+		endSpan(span, nil)
+	} else {
+		endSpan(span, err)
+	}
+	return err
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// workPool ограничивает число одновременных decode/resize/encode.
+// Сверх workers ждут в очереди не больше maxQueue запросов и не дольше timeout, остальным — 503.
+type workPool struct {
+	slots    chan struct{}
+	waiting  atomic.Int64
+	maxQueue int64
+	timeout  time.Duration
+}
+
+func newWorkPool(workers, maxQueue int, timeout time.Duration) *workPool {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if maxQueue < 0 {
+		maxQueue = workers * 4
+	}
+	return &workPool{
+		slots:    make(chan struct{}, workers),
+		maxQueue: int64(maxQueue),
+		timeout:  timeout,
+	}
+}
+
+// acquire занимает слот; release обязателен.
+func (p *workPool) acquire(ctx context.Context) (func(), error) {
+	release := func() {
+		<-p.slots
+		poolBusy.Dec()
+	}
+
+	// свободный слот — без очереди
+	select {
+	case p.slots <- struct{}{}:
+		poolBusy.Inc()
+		poolWait.Observe(0)
+		return release, nil
+	default:
+	}
+
+	if n := p.waiting.Add(1); n > p.maxQueue {
+		p.waiting.Add(-1)
+		poolRejected.WithLabelValues("queue_full").Inc()
+		return nil, p.overloaded()
+	}
+	poolQueued.Inc()
+	defer func() {
+		p.waiting.Add(-1)
+		poolQueued.Dec()
+	}()
+
+	start := time.Now()
+	t := time.NewTimer(p.timeout)
+	defer t.Stop()
+	select {
+	case p.slots <- struct{}{}:
+		poolBusy.Inc()
+		poolWait.Observe(time.Since(start).Seconds())
+		return release, nil
+	case <-t.C:
+		poolWait.Observe(time.Since(start).Seconds())
+		poolRejected.WithLabelValues("timeout").Inc()
+		return nil, p.overloaded()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// acquireIdle — для фоновых задач: слот берём, только когда живые запросы не ждут в очереди.
+func (p *workPool) acquireIdle(ctx context.Context) (func(), error) {
+	for {
+		if p.waiting.Load() == 0 {
+			select {
+			case p.slots <- struct{}{}:
+				poolBusy.Inc()
+				return func() {
+					<-p.slots
+					poolBusy.Dec()
+				}, nil
+			default:
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// saturated — все воркеры заняты и кто-то уже ждёт.
+func (p *workPool) saturated() bool {
+	return len(p.slots) == cap(p.slots) && p.waiting.Load() > 0
+}
+
+func (p *workPool) overloaded() error {
+	e := newError(errOverloaded, "server is busy, retry later", nil)
+	e.retryAfter = max(p.timeout, time.Second)
+	return e
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/go-chi/chi/v5"
+)
+
+// purgeResult — что удалили и что сказал CDN.
+type purgeResult struct {
+	Type    string   `json:"type"`
+	ID      int      `json:"id"`
+	Hash    string   `json:"hash,omitempty"`
+	Deleted []string `json:"deleted"`
+	Errors  []string `json:"errors,omitempty"`
+	Webhook string   `json:"webhook,omitempty"` // ok, error: …; пусто — вебхук не настроен
+}
+
+// purgeWebhook — POST JSON {"type","id","hash","keys","urls"} после удаления, чтобы CDN сбросил свои копии.
+type purgeWebhook struct {
+	url     string
+	auth    string
+	urlBase string // публичный адрес /sss, из него строим urls
+	client  *http.Client
+}
+
+func loadPurgeWebhook() *purgeWebhook {
+	u := env("PURGE_WEBHOOK_URL", "")
+	if u == "" {
+		return nil
+	}
+	return &purgeWebhook{
+		url:     u,
+		auth:    env("PURGE_WEBHOOK_AUTH", ""),
+		urlBase: strings.TrimSuffix(env("PURGE_URL_BASE", ""), "/"),
+		client:  &http.Client{Timeout: envDuration("PURGE_WEBHOOK_TIMEOUT", 10*time.Second)},
+	}
+}
+
+// allVariantNames — все имена, которые может породить hash: оригинал и каждый допустимый ресайз.
+func allVariantNames(hash string) []string {
+	out := []string{hash}
+	for v := 100; v <= 1000; v += 100 {
+		out = append(out, variantName(hash, strconv.Itoa(v)), variantName(hash, "h"+strconv.Itoa(v)))
+	}
+	return out
+}
+
+// purge удаляет оригинал и все ресайзы hash, а при hash == "" — всё, что лежит под type/id.
+// Без ListObjects по hash удаляем перечислением всех возможных имён, по type/id — никак.
+func (a *App) purge(ctx context.Context, typ string, id int, hash string) (*purgeResult, error) {
+	caps := a.storage()
+	if !caps.Delete.allowed() {
+		return nil, newError(errStorage, "purge is disabled: storage denies DeleteObject", nil)
+	}
+	res := &purgeResult{Type: typ, ID: id, Hash: hash, Deleted: []string{}}
+
+	var keys []string
+	switch {
+	case caps.List.allowed():
+		var err error
+		if keys, err = a.listPurgeKeys(ctx, typ, id, hash); err != nil {
+			return nil, storageError("storage list failed", err)
+		}
+	case hash != "":
+		for _, name := range allVariantNames(hash) {
+			keys = append(keys, a.objectKey(typ, id, name))
+		}
+	default:
+		return nil, newError(errStorage, "purge by type/id needs ListObjects, which storage denies", nil)
+	}
+
+	// не даём очереди залить обратно то, что было поставлено до purge
+	a.uploads.forget(a.objectKey(typ, id, hash), time.Now())
+
+	for start := 0; start < len(keys); start += 1000 {
+		batch := keys[start:min(start+1000, len(keys))]
+		objs := make([]types.ObjectIdentifier, len(batch))
+		for i, k := range batch {
+			objs[i] = types.ObjectIdentifier{Key: aws.String(k)}
+		}
+		out, err := a.s3.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(a.bucket),
+			Delete: &types.Delete{Objects: objs, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return nil, storageError("storage delete failed", err)
+		}
+		failed := map[string]bool{}
+		for _, e := range out.Errors {
+			failed[aws.ToString(e.Key)] = true
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: %s", aws.ToString(e.Key), aws.ToString(e.Message)))
+		}
+		for _, k := range batch {
+			if !failed[k] {
+				res.Deleted = append(res.Deleted, k)
+			}
+		}
+	}
+	purgedObjects.Add(float64(len(res.Deleted)))
+	slog.InfoContext(ctx, "purged", "type", typ, "id", id, "hash", hash, "deleted", len(res.Deleted), "errors", len(res.Errors))
+
+	if a.purgeHook != nil {
+		if err := a.purgeHook.notify(ctx, res); err != nil {
+			res.Webhook = "error: " + err.Error()
+			slog.WarnContext(ctx, "purge webhook failed", "err", err)
+		} else {
+			res.Webhook = "ok"
+		}
+	}
+	return res, nil
+}
+
+func (a *App) listPurgeKeys(ctx context.Context, typ string, id int, hash string) ([]string, error) {
+	dir := a.objectKey(typ, id, "")
+	p := s3.NewListObjectsV2Paginator(a.s3, &s3.ListObjectsV2Input{
+		Bucket: aws.String(a.bucket),
+		Prefix: aws.String(dir + hash),
+	})
+	var keys []string
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range page.Contents {
+			k := aws.ToString(o.Key)
+			// по префиксу hash попадут и другие hash с тем же началом — оставляем только свои
+			if name := strings.TrimPrefix(k, dir); hash == "" || name == hash || strings.HasPrefix(name, hash+"@") {
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys, nil
+}
+
+func (h *purgeWebhook) notify(ctx context.Context, res *purgeResult) error {
+	payload := map[string]any{"type": res.Type, "id": res.ID, "hash": res.Hash, "keys": res.Deleted}
+	if h.urlBase != "" {
+		urls := make([]string, 0, len(res.Deleted))
+		for _, k := range res.Deleted {
+			if i := strings.Index(k, "/"+res.Type+"/"); i >= 0 {
+				urls = append(urls, h.urlBase+k[i:])
+			}
+		}
+		payload["urls"] = urls
+	}
+	body, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.auth != "" {
+		req.Header.Set("Authorization", h.auth)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// handleAdminPurge — POST /admin/purge/{type}/{id}[/{hash}].
+func (a *App) handleAdminPurge(w http.ResponseWriter, r *http.Request) {
+	typ := chi.URLParam(r, "type")
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id <= 0 {
+		a.writeError(w, r, errBadRequestf("bad id"))
+		return
+	}
+	hash := chi.URLParam(r, "hash")
+	if strings.ContainsAny(hash, "@/") || strings.Contains(typ, "/") {
+		a.writeError(w, r, errBadRequestf("bad hash"))
+		return
+	}
+	res, err := a.purge(r.Context(), typ, id, hash)
+	if err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// singleRange возвращает Range в виде, пригодном для S3 GetObject.
+// Поддерживаем только один диапазон: bytes=a-b, bytes=a-, bytes=-n.
+// Мульти-диапазоны и мусор игнорируем — по RFC 9110 это значит отдать 200 целиком.
+func singleRange(h string) string {
+	h = strings.TrimSpace(h)
+	spec, ok := strings.CutPrefix(h, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return ""
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok || (first == "" && last == "") {
+		return ""
+	}
+	var start, end int64 = -1, -1
+	if first != "" {
+		v, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || v < 0 {
+			return ""
+		}
+		start = v
+	}
+	if last != "" {
+		v, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || v < 0 {
+			return ""
+		}
+		end = v
+	}
+	if start >= 0 && end >= 0 && end < start {
+		return ""
+	}
+	if start < 0 && end == 0 {
+		return ""
+	}
+	return "bytes=" + first + "-" + last
+}
+
+// ifRangeValidator разбирает If-Range: либо сильный ETag, либо дата.
+// weak=true — валидатор не годится для If-Range, Range надо проигнорировать.
+func ifRangeValidator(h string) (etag string, date time.Time, weak bool) {
+	h = strings.TrimSpace(h)
+	if h == "" {
+		return "", time.Time{}, false
+	}
+	if strings.HasPrefix(h, "W/") {
+		return "", time.Time{}, true
+	}
+	if strings.HasPrefix(h, `"`) {
+		return strings.Trim(h, `"`), time.Time{}, false
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		return "", t, false
+	}
+	// старые ответы отдавали ETag без кавычек — клиенты так его и возвращают
+	if !strings.ContainsAny(h, " ,") {
+		return h, time.Time{}, false
+	}
+	return "", time.Time{}, true
+}
+
+// ifRangeMatches — сильное сравнение для If-Range; пустой валидатор совпадает всегда.
+func ifRangeMatches(etag string, date time.Time, curEtag string, lastMod time.Time) bool {
+	switch {
+	case etag != "":
+		return etag == curEtag
+	case !date.IsZero():
+		return !lastMod.IsZero() && lastMod.Truncate(time.Second).Equal(date)
+	default:
+		return true
+	}
+}
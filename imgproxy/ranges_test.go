@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSingleRange(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"bytes=0-99", "bytes=0-99"},
+		{"bytes=100-", "bytes=100-"},
+		{"bytes=-500", "bytes=-500"},
+		{" bytes=5-5 ", "bytes=5-5"},
+		{"bytes= 0-99", "bytes=0-99"},
+		{"", ""},
+		{"bytes=", ""},
+		{"bytes=-", ""},
+		{"bytes=-0", ""},
+		{"bytes=10-5", ""},
+		{"bytes=0-1,5-9", ""},
+		{"bytes=a-b", ""},
+		{"bytes=--5", ""},
+		{"items=0-99", ""},
+	} {
+		if got := singleRange(tc.in); got != tc.want {
+			t.Errorf("singleRange(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestIfRangeValidator(t *testing.T) {
+	date := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		in   string
+		etag string
+		date time.Time
+		weak bool
+	}{
+		{"", "", time.Time{}, false},
+		{`"abc"`, "abc", time.Time{}, false},
+		{"abc", "abc", time.Time{}, false},
+		{`W/"abc"`, "", time.Time{}, true},
+		{date.Format(http.TimeFormat), "", date, false},
+		{"not a date, really", "", time.Time{}, true},
+	} {
+		etag, d, weak := ifRangeValidator(tc.in)
+		if etag != tc.etag || !d.Equal(tc.date) || weak != tc.weak {
+			t.Errorf("ifRangeValidator(%q) = %q, %v, %v; want %q, %v, %v", tc.in, etag, d, weak, tc.etag, tc.date, tc.weak)
+		}
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	lastMod := time.Date(2024, 1, 2, 3, 4, 5, 600, time.UTC)
+	sec := lastMod.Truncate(time.Second)
+	for _, tc := range []struct {
+		name string
+		etag string
+		date time.Time
+		want bool
+	}{
+		{"no validator", "", time.Time{}, true},
+		{"same etag", "abc", time.Time{}, true},
+		{"other etag", "abd", time.Time{}, false},
+		{"same date", "", sec, true},
+		{"older date", "", sec.Add(-time.Second), false},
+	} {
+		if got := ifRangeMatches(tc.etag, tc.date, "abc", lastMod); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	if ifRangeMatches("", sec, "abc", time.Time{}) {
+		t.Error("date validator without Last-Modified must not match")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenLimiter — token bucket на клиента. Клиентов держим в LRU, чтобы память была ограничена:
+// вытесняется самый давно молчавший, а его корзина к этому моменту всё равно полная.
+type tokenLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // токенов в секунду
+	burst   float64
+	max     int
+	lru     *list.List
+	buckets map[string]*list.Element
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func newTokenLimiter(rps, burst float64, maxClients int) *tokenLimiter {
+	return &tokenLimiter{
+		rate:    rps,
+		burst:   math.Max(burst, 1),
+		max:     maxClients,
+		lru:     list.New(),
+		buckets: map[string]*list.Element{},
+	}
+}
+
+// take забирает токен; если нельзя — говорит, сколько ждать.
+func (l *tokenLimiter) take(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var b *bucket
+	if el, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(el)
+		b = el.Value.(*bucket)
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	} else {
+		b = &bucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+		for l.lru.Len() > l.max {
+			old := l.lru.Back()
+			l.lru.Remove(old)
+			delete(l.buckets, old.Value.(*bucket).key)
+		}
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.rate <= 0 {
+		return false, time.Minute
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+type rateLimits struct {
+	requests  *tokenLimiter // все запросы, в т.ч. попадания в кеш
+	misses    *tokenLimiter // промахи: БД + апстрим + ресайз, бюджет строже
+	trusted   []*net.IPNet
+	apiHeader string
+	apiKeys   map[string]bool
+}
+
+func loadRateLimits() (*rateLimits, error) {
+	if !envBool("RATE_LIMIT", false) {
+		return nil, nil
+	}
+	maxClients := int(envInt64("RATE_LIMIT_MAX_CLIENTS", 100000))
+	rl := &rateLimits{
+		requests:  newTokenLimiter(envFloat("RATE_LIMIT_RPS", 50), envFloat("RATE_LIMIT_BURST", 100), maxClients),
+		misses:    newTokenLimiter(envFloat("RATE_LIMIT_MISS_RPS", 2), envFloat("RATE_LIMIT_MISS_BURST", 20), maxClients),
+		apiHeader: env("RATE_LIMIT_API_KEY_HEADER", "X-API-Key"),
+		apiKeys:   map[string]bool{},
+	}
+	for _, k := range splitList(env("RATE_LIMIT_API_KEYS", "")) {
+		rl.apiKeys[k] = true
+	}
+	for _, c := range splitList(env("TRUSTED_PROXIES", "")) {
+		if !strings.Contains(c, "/") {
+			if strings.Contains(c, ":") {
+				c += "/128"
+			} else {
+				c += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("bad TRUSTED_PROXIES entry %q: %w", c, err)
+		}
+		rl.trusted = append(rl.trusted, n)
+	}
+	return rl, nil
+}
+
+func (rl *rateLimits) isTrusted(ip net.IP) bool {
+	for _, n := range rl.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientKey: известный API-ключ, иначе IP клиента. X-Forwarded-For читаем справа налево
+// и только пока адреса принадлежат нашим доверенным прокси — левее клиент может написать что угодно.
+func (rl *rateLimits) clientKey(r *http.Request) string {
+	if k := r.Header.Get(rl.apiHeader); k != "" && rl.apiKeys[k] {
+		return "key:" + k
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !rl.isTrusted(ip) {
+		return "ip:" + host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		hip := net.ParseIP(hop)
+		if hip == nil {
+			break
+		}
+		host = hop
+		if !rl.isTrusted(hip) {
+			break
+		}
+	}
+	return "ip:" + host
+}
+
+type ctxKeyClient struct{}
+
+func tooManyRequests(budget string, wait time.Duration) error {
+	rateLimited.WithLabelValues(budget).Inc()
+	e := newError(errTooManyRequests, "rate limit exceeded", nil)
+	e.retryAfter = wait
+	return e
+}
+
+// rateLimit — общий бюджет запросов на клиента.
+func (a *App) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.limits == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := a.limits.clientKey(r)
+		if ok, wait := a.limits.requests.take(key, time.Now()); !ok {
+			a.writeError(w, r, tooManyRequests("requests", wait))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKeyClient{}, key)))
+	})
+}
+
+// takeMissBudget вызывается, когда кеш не помог и дальше будет БД/апстрим/ресайз.
+func (a *App) takeMissBudget(r *http.Request) error {
+	if a.limits == nil {
+		return nil
+	}
+	key, _ := r.Context().Value(ctxKeyClient{}).(string)
+	if key == "" {
+		key = a.limits.clientKey(r)
+	}
+	if ok, wait := a.limits.misses.take(key, time.Now()); !ok {
+		return tooManyRequests("misses", wait)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenLimiterTake(t *testing.T) {
+	l := newTokenLimiter(2, 3, 10)
+	now := time.Unix(1_700_000_000, 0)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.take("a", now); !ok {
+			t.Fatalf("take %d within burst refused", i)
+		}
+	}
+	ok, wait := l.take("a", now)
+	if ok {
+		t.Fatal("take over burst allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Fatalf("wait = %v, want 500ms", wait)
+	}
+	// у другого клиента своя корзина
+	if ok, _ := l.take("b", now); !ok {
+		t.Fatal("other client refused")
+	}
+	// через полсекунды накопился ровно один токен
+	if ok, _ := l.take("a", now.Add(500*time.Millisecond)); !ok {
+		t.Fatal("refill after 500ms refused")
+	}
+	if ok, _ := l.take("a", now.Add(500*time.Millisecond)); ok {
+		t.Fatal("second take after refill allowed")
+	}
+	// корзина не копит больше burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.take("a", later); !ok {
+			t.Fatalf("take %d after long pause refused", i)
+		}
+	}
+	if ok, _ := l.take("a", later); ok {
+		t.Fatal("burst exceeded after long pause")
+	}
+}
+
+func TestTokenLimiterZeroRate(t *testing.T) {
+	l := newTokenLimiter(0, 1, 10)
+	now := time.Unix(1_700_000_000, 0)
+	if ok, _ := l.take("a", now); !ok {
+		t.Fatal("first take refused")
+	}
+	if ok, wait := l.take("a", now.Add(time.Hour)); ok || wait != time.Minute {
+		t.Fatalf("got %v, %v; want refused with 1m", ok, wait)
+	}
+}
+
+func TestTokenLimiterEviction(t *testing.T) {
+	l := newTokenLimiter(1, 1, 2)
+	now := time.Unix(1_700_000_000, 0)
+	l.take("a", now)
+	l.take("b", now)
+	l.take("a", now) // a теперь свежее b
+	l.take("c", now) // вытесняет b
+	if l.lru.Len() != 2 {
+		t.Fatalf("lru len = %d, want 2", l.lru.Len())
+	}
+	if _, ok := l.buckets["b"]; ok {
+		t.Fatal("least recently used client not evicted")
+	}
+	// вытесненный клиент возвращается с полной корзиной
+	if ok, _ := l.take("b", now); !ok {
+		t.Fatal("evicted client refused")
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	t.Setenv("RATE_LIMIT", "true")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.1, ::1")
+	t.Setenv("RATE_LIMIT_API_KEYS", "secret")
+	rl, err := loadRateLimits()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		remote string
+		xff    []string
+		apiKey string
+		want   string
+	}{
+		{"direct client", "203.0.113.7:1234", nil, "", "ip:203.0.113.7"},
+		{"untrusted peer, xff ignored", "203.0.113.7:1234", []string{"198.51.100.1"}, "", "ip:203.0.113.7"},
+		{"trusted peer", "10.1.2.3:1234", []string{"198.51.100.1"}, "", "ip:198.51.100.1"},
+		{"trusted peer without xff", "10.1.2.3:1234", nil, "", "ip:10.1.2.3"},
+		{"single trusted ip", "192.168.1.1:1234", []string{"198.51.100.1"}, "", "ip:198.51.100.1"},
+		{"ipv6 trusted peer", "[::1]:1234", []string{"198.51.100.1"}, "", "ip:198.51.100.1"},
+		{"spoofed left part", "10.1.2.3:1234", []string{"1.1.1.1, 198.51.100.1"}, "", "ip:198.51.100.1"},
+		{"chain of proxies", "10.1.2.3:1234", []string{"198.51.100.1, 10.9.9.9"}, "", "ip:198.51.100.1"},
+		{"several headers", "10.1.2.3:1234", []string{"198.51.100.1", "10.9.9.9"}, "", "ip:198.51.100.1"},
+		{"garbage hop stops walk", "10.1.2.3:1234", []string{"198.51.100.1, junk, 10.9.9.9"}, "", "ip:10.9.9.9"},
+		{"all hops trusted", "10.1.2.3:1234", []string{"10.8.8.8, 10.9.9.9"}, "", "ip:10.8.8.8"},
+		{"known api key", "203.0.113.7:1234", nil, "secret", "key:secret"},
+		{"unknown api key", "203.0.113.7:1234", nil, "guess", "ip:203.0.113.7"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/sss/videos/1/abc", nil)
+			r.RemoteAddr = tc.remote
+			for _, v := range tc.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tc.apiKey != "" {
+				r.Header.Set("X-API-Key", tc.apiKey)
+			}
+			if got := rl.clientKey(r); got != tc.want {
+				t.Fatalf("clientKey = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadRateLimitsBadProxy(t *testing.T) {
+	t.Setenv("RATE_LIMIT", "true")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/33")
+	if _, err := loadRateLimits(); err == nil {
+		t.Fatal("want error for bad TRUSTED_PROXIES")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readiness кеширует результат проверок на ttl, чтобы частые пробы k8s не долбили БД и хранилище.
+type readiness struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	timeout time.Duration
+	checked time.Time
+	report  readyReport
+}
+
+type readyReport struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentStatus `json:"components"`
+}
+
+type componentStatus struct {
+	Status    string   `json:"status"` // ok, fail, degraded
+	Error     string   `json:"error,omitempty"`
+	OpenHosts []string `json:"open_hosts,omitempty"`
+	Down      []string `json:"down,omitempty"`
+}
+
+func loadReadiness() *readiness {
+	return &readiness{
+		ttl:     envDuration("READY_CACHE_TTL", 5*time.Second),
+		timeout: envDuration("READY_TIMEOUT", 2*time.Second),
+	}
+}
+
+func (a *App) Readyz(w http.ResponseWriter, r *http.Request) {
+	// живой ли апп и готов ли к работе (БД, хранилище)
+	if a.shuttingDown.Load() {
+		a.writeReady(w, r, http.StatusServiceUnavailable, readyReport{Status: "shutting_down"})
+		return
+	}
+	rep := a.ready.get(r.Context(), a.checkReady)
+	code := http.StatusOK
+	if rep.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	a.writeReady(w, r, code, rep)
+}
+
+func (a *App) writeReady(w http.ResponseWriter, r *http.Request, code int, rep readyReport) {
+	if r.Method == http.MethodHead {
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		return
+	}
+	writeJSON(w, code, rep)
+}
+
+func (rd *readiness) get(ctx context.Context, check func(context.Context) readyReport) readyReport {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if !rd.checked.IsZero() && time.Since(rd.checked) < rd.ttl {
+		return rd.report
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rd.timeout)
+	defer cancel()
+	rd.report = check(ctx)
+	rd.checked = time.Now()
+	return rd.report
+}
+
+// checkReady: БД и хранилище обязательны. Открытый breaker апстрима готовность не снимает —
+// апстрим общий для всех подов, и снимать их все из балансера бессмысленно; только показываем.
+func (a *App) checkReady(ctx context.Context) readyReport {
+	rep := readyReport{Status: "ok", Components: map[string]componentStatus{}}
+
+	var wg sync.WaitGroup
+	var dbErr, s3Err error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		dbErr = a.db.PingContext(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		s3Err = a.checkS3Read(ctx, fmt.Sprintf("%s/__ready_probe", a.probePrefix()))
+	}()
+	wg.Wait()
+
+	rep.Components["mysql"] = readyComponent(dbErr)
+	rep.Components["storage"] = readyComponent(s3Err)
+	if dbErr != nil || s3Err != nil {
+		rep.Status = "fail"
+	}
+
+	if a.reads != nil && len(a.reads.replicas) > 0 {
+		// упавшие реплики готовность не снимают — чтение уходит на primary
+		rc := componentStatus{Status: "ok"}
+		for _, r := range a.reads.replicas {
+			if !r.healthy.Load() {
+				rc.Status = "degraded"
+				rc.Down = append(rc.Down, r.name)
+			}
+		}
+		rep.Components["mysql_replicas"] = rc
+	}
+
+	up := componentStatus{Status: "ok"}
+	if hosts := a.breaker.openHosts(); len(hosts) > 0 {
+		up = componentStatus{Status: "degraded", OpenHosts: hosts}
+	}
+	rep.Components["upstream"] = up
+	return rep
+}
+
+func readyComponent(err error) componentStatus {
+	if err != nil {
+		return componentStatus{Status: "fail", Error: err.Error()}
+	}
+	return componentStatus{Status: "ok"}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	redirectOff     = ""
+	redirectPresign = "presign"
+	redirectPublic  = "public"
+)
+
+type storageRedirect struct {
+	mode         string
+	status       int
+	publicBase   string
+	presignTTL   time.Duration
+	cacheControl string
+	presign      *s3.PresignClient
+}
+
+func loadStorageRedirect(s3c *s3.Client) (*storageRedirect, error) {
+	sr := &storageRedirect{
+		mode:       strings.ToLower(env("STORAGE_REDIRECT", "off")),
+		publicBase: strings.TrimSuffix(env("STORAGE_PUBLIC_URL", ""), "/"),
+		presignTTL: envDuration("STORAGE_PRESIGN_TTL", time.Hour),
+	}
+	switch sr.mode {
+	case "off", "false", "0":
+		sr.mode = redirectOff
+		return sr, nil
+	case redirectPresign:
+		sr.presign = s3.NewPresignClient(s3c)
+		// ответ с редиректом не должен жить дольше подписи
+		sr.cacheControl = env("STORAGE_REDIRECT_CACHE_CONTROL",
+			"public, max-age="+strconv.Itoa(int(sr.presignTTL/2/time.Second)))
+	case redirectPublic:
+		if sr.publicBase == "" {
+			return nil, fmt.Errorf("STORAGE_REDIRECT=public requires STORAGE_PUBLIC_URL")
+		}
+		sr.cacheControl = env("STORAGE_REDIRECT_CACHE_CONTROL", "public, max-age=86400")
+	default:
+		return nil, fmt.Errorf("bad STORAGE_REDIRECT %q: want off, presign or public", sr.mode)
+	}
+
+	switch st := envInt64("STORAGE_REDIRECT_STATUS", http.StatusFound); st {
+	case http.StatusFound, http.StatusTemporaryRedirect:
+		sr.status = int(st)
+	default:
+		return nil, fmt.Errorf("bad STORAGE_REDIRECT_STATUS %d: want 302 or 307", st)
+	}
+	return sr, nil
+}
+
+// redirectToStorageIfPresent — для попаданий в кеш не гоним байты через под,
+// а отправляем клиента прямо в бакет. Наличие объекта проверяем дешёвым HeadObject (или GET первого байта, если HEAD запрещён).
+func (a *App) redirectToStorageIfPresent(
+	w http.ResponseWriter,
+	r *http.Request,
+	key string,
+	source string,
+	start time.Time,
+) (bool, error) {
+	info, ok, err := a.statObject(r.Context(), key)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if notModified(r, info.etag, info.lastModified) {
+		writeNotModified(w, r, info.contentType, info.etag, info.lastModified, source, time.Since(start))
+		return true, nil
+	}
+
+	var target string
+	switch a.redirect.mode {
+	case redirectPublic:
+		target = a.redirect.publicBase + "/" + key
+	case redirectPresign:
+		req, err := a.redirect.presign.PresignGetObject(r.Context(), &s3.GetObjectInput{
+			Bucket: &a.bucket,
+			Key:    &key,
+		}, s3.WithPresignExpires(a.redirect.presignTTL))
+		if err != nil {
+			return false, err
+		}
+		target = req.URL
+	}
+
+	w.Header().Set("Location", target)
+	w.Header().Set("Cache-Control", a.redirect.cacheControl)
+	w.Header().Set("X-B-Source", "redirect-"+source)
+	w.Header().Set("X-Req-Ms", fmt.Sprintf("%.2f", float64(time.Since(start).Microseconds())/1000.0))
+	w.WriteHeader(a.redirect.status)
+	return true, nil
+}
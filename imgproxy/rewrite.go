@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Правила по умолчанию: в БД часто лежат ссылки на маленькие превью,
+// хотя у источника есть версия крупнее.
+const defaultRewriteRules = `
+# TMDB: /t/p/w500/... -> /t/p/original/...
+^(https?://image\.tmdb\.org/t/p/)w\d+/(.+)$ => ${1}original/${2}
+# Кинопоиск: actor_iphone/iphone360_ID.jpg -> actor/ID.jpg
+^(https?://st\.kp\.yandex\.net/images/)actor_iphone/iphone\d+_(\d+\.jpg)$ => ${1}actor/${2}
+`
+
+type rewriteRule struct {
+	re   *regexp.Regexp
+	tmpl string
+}
+
+// parseRewriteRules разбирает правила вида `regex => template`, по одному на строку.
+// Пустые строки и строки с # пропускаются. В template доступны группы ${1}, ${name}.
+func parseRewriteRules(src string) ([]rewriteRule, error) {
+	var rules []rewriteRule
+	sc := bufio.NewScanner(strings.NewReader(src))
+	n := 0
+	for sc.Scan() {
+		n++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern, tmpl, ok := strings.Cut(line, "=>")
+		if !ok {
+			return nil, fmt.Errorf("rewrite rule line %d: missing =>", n)
+		}
+		re, err := regexp.Compile(strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("rewrite rule line %d: %w", n, err)
+		}
+		rules = append(rules, rewriteRule{re: re, tmpl: strings.TrimSpace(tmpl)})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func loadRewriteRules() ([]rewriteRule, error) {
+	if !envBool("URL_REWRITE", true) {
+		return nil, nil
+	}
+	src := defaultRewriteRules
+	if f := env("URL_REWRITE_RULES_FILE", ""); f != "" {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("read URL_REWRITE_RULES_FILE: %w", err)
+		}
+		src = string(b)
+	} else if v := env("URL_REWRITE_RULES", ""); v != "" {
+		src = v
+	}
+	return parseRewriteRules(src)
+}
+
+// rewriteURL применяет первое подходящее правило.
+func (a *App) rewriteURL(u string) (string, bool) {
+	for _, rule := range a.rewriteRules {
+		m := rule.re.FindStringSubmatchIndex(u)
+		if m == nil {
+			continue
+		}
+		out := string(rule.re.ExpandString(nil, rule.tmpl, u, m))
+		if out == "" || out == u {
+			return u, false
+		}
+		return out, true
+	}
+	return u, false
+}
+
+// fetchOriginal качает оригинал, пробуя сначала переписанный (более качественный) URL.
+// Если по нему 404 или ошибка — откатываемся на исходный URL из БД.
+func (a *App) fetchOriginal(ctx context.Context, remoteURL string) (*remoteBody, error) {
+	if better, ok := a.rewriteURL(remoteURL); ok {
+		body, err := a.fetchRemoteWithRedirects(ctx, better)
+		if err == nil {
+			return body, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		slog.InfoContext(ctx, "rewritten url failed, fallback to original", "url", better, "err", err)
+	}
+	return a.fetchRemoteWithRedirects(ctx, remoteURL)
+}
@@ -1,13 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/md5"
-	"encoding/hex"
 	"errors"
 	"io"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -16,9 +12,12 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func (a *App) getObject(ctx context.Context, key string) ([]byte, string, string, bool, error) {
+// openObject открывает объект на чтение; ok=false если его нет. Body закрывает вызывающий.
+func (a *App) openObject(ctx context.Context, key string) (io.ReadCloser, string, string, bool, error) {
+	defer stage(ctx, "storage")()
 	out, err := a.s3.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(a.bucket),
 		Key:    aws.String(key),
@@ -30,61 +29,60 @@ func (a *App) getObject(ctx context.Context, key string) ([]byte, string, string
 		}
 		return nil, "", "", false, err
 	}
-	defer out.Body.Close()
+	ct := aws.ToString(out.ContentType)
+	return out.Body, ct, objectETag(out.Metadata, out.ETag), true, nil
+}
 
-	b, err := io.ReadAll(out.Body)
-	if err != nil {
-		return nil, "", "", false, err
+// objectETag — стабильный сильный ETag: md5 содержимого.
+// Берём из метаданных (их пишет putObject), иначе ETag самого S3 — для обычного PUT это тот же md5.
+// Так ETag одинаковый и для свежесгенерированного ответа, и для отданного из кеша.
+func objectETag(meta map[string]string, s3etag *string) string {
+	if v := meta["md5"]; v != "" {
+		return v
 	}
-	ct := aws.ToString(out.ContentType)
-	etag := strings.Trim(aws.ToString(out.ETag), `"`)
-	return b, ct, etag, true, nil
+	return strings.Trim(aws.ToString(s3etag), `"`)
 }
 
-func (a *App) putObject(ctx context.Context, key, contentType string, data []byte) (string, error) {
+func (a *App) putObject(ctx context.Context, key, contentType string, body *spool, meta map[string]string) (string, error) {
+	rd, err := body.Reader()
+	if err != nil {
+		return "", err
+	}
+	md := map[string]string{"md5": body.MD5()}
+	for k, v := range meta {
+		md[k] = v
+	}
 	out, err := a.s3.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:       aws.String(a.bucket),
-		Key:          aws.String(key),
-		Body:         bytes.NewReader(data),
-		ContentType:  aws.String(contentType),
-		CacheControl: aws.String("public, max-age=31536000, immutable"),
+		Bucket:        aws.String(a.bucket),
+		Key:           aws.String(key),
+		Body:          rd,
+		ContentLength: aws.Int64(body.Size()),
+		ContentType:   aws.String(contentType),
+		CacheControl:  aws.String("public, max-age=31536000, immutable"),
+		Metadata:      md,
 	})
 	if err != nil {
 		return "", err
 	}
 	etag := strings.Trim(aws.ToString(out.ETag), `"`)
 	if etag == "" {
-		sum := md5.Sum(data)
-		etag = hex.EncodeToString(sum[:])
+		etag = body.MD5()
 	}
 	return etag, nil
 }
 
-func (a *App) uploadAsync(key, ct string, data []byte) {
-	// ограничиваем параллелизм
-	select {
-	case a.uploadSem <- struct{}{}:
-		// ok
-	default:
-		log.Printf("async upload skipped (busy): %s", key)
-		return
-	}
-
-	go func() {
-		defer func() { <-a.uploadSem }()
-
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
+// uploadAsync забирает body себе и закрывает его после заливки (см. uploadQueue).
+// ctx нужен только для связи спана заливки со спаном запроса.
+func (a *App) uploadAsync(ctx context.Context, key, ct string, body *spool, meta map[string]string) {
+	a.uploads.enqueue(&uploadTask{Key: key, CT: ct, Meta: meta, body: body, link: trace.SpanContextFromContext(ctx)})
+}
 
-		if _, err := a.putObject(ctx, key, ct, data); err != nil {
-			log.Printf("async upload failed key=%s err=%v", key, err)
-		} else {
-			log.Printf("async upload ok key=%s", key)
-		}
-	}()
+// uploadIngest — заливка нового оригинала; после успеха рендерим пресеты (afterIngest).
+func (a *App) uploadIngest(ctx context.Context, key, ct string, body *spool, typ string, id int, hash string) {
+	a.uploads.enqueue(&uploadTask{Key: key, CT: ct, body: body, Ingest: &ingestRef{Type: typ, ID: id, Hash: hash}, link: trace.SpanContextFromContext(ctx)})
 }
 
-// Возвращает true если ответ уже отправлен (304 или 200 из кеша), иначе false.
+// Возвращает true если ответ уже отправлен (304, 200/206 из кеша, 416 или редирект в бакет), иначе false.
 func (a *App) serveFromS3IfPresent(
 	w http.ResponseWriter,
 	r *http.Request,
@@ -92,38 +90,75 @@ func (a *App) serveFromS3IfPresent(
 	source string,
 	start time.Time,
 ) (bool, error) {
-	out, err := a.s3.GetObject(r.Context(), &s3.GetObjectInput{
+	if a.redirect.mode != redirectOff {
+		return a.redirectToStorageIfPresent(w, r, key, source, start)
+	}
+	if r.Method == http.MethodHead {
+		return a.headFromS3IfPresent(w, r, key, source, start)
+	}
+
+	in := &s3.GetObjectInput{
 		Bucket: &a.bucket,
 		Key:    &key,
-	})
+	}
+	// Range пробрасываем в S3 как есть; If-Range проверяем по ответу
+	var irEtag string
+	var irDate time.Time
+	if rng := singleRange(r.Header.Get("Range")); rng != "" {
+		var weak bool
+		irEtag, irDate, weak = ifRangeValidator(r.Header.Get("If-Range"))
+		if !weak {
+			in.Range = aws.String(rng)
+		}
+	}
+
+	doneStorage := stage(r.Context(), "storage")
+	out, err := a.s3.GetObject(r.Context(), in)
+	if err == nil && in.Range != nil && !ifRangeMatches(irEtag, irDate, objectETag(out.Metadata, out.ETag), aws.ToTime(out.LastModified)) {
+		// If-Range не совпал — отдаём объект целиком
+		out.Body.Close()
+		in.Range = nil
+		out, err = a.s3.GetObject(r.Context(), in)
+	}
+	doneStorage()
 	if err != nil {
 		var nsk *types.NoSuchKey
 		if errors.As(err, &nsk) || strings.Contains(err.Error(), "NoSuchKey") || strings.Contains(err.Error(), "NotFound") {
 			return false, nil
 		}
+		if in.Range != nil && isS3InvalidRange(err) {
+			a.writeRangeNotSatisfiable(w, r, key)
+			return true, nil
+		}
 		return false, err
 	}
 	defer out.Body.Close()
 
 	ct := aws.ToString(out.ContentType)
-	etag := strings.Trim(aws.ToString(out.ETag), `"`)
+	etag := objectETag(out.Metadata, out.ETag)
+	lastMod := aws.ToTime(out.LastModified)
 	size := aws.ToInt64(out.ContentLength)
 
-	// 304 без скачивания тела
-	if inm := strings.Trim(r.Header.Get("If-None-Match"), `"`); inm != "" && etag != "" && inm == etag {
-		// Можно тоже добавить полезные заголовки (ETag, Cache-Control)
-		writeCommon(w, r, ct, etag, source, time.Since(start))
-		w.WriteHeader(http.StatusNotModified)
+	// 304 без чтения тела
+	if notModified(r, etag, lastMod) {
+		writeNotModified(w, r, ct, etag, lastMod, source, time.Since(start))
 		return true, nil
 	}
 
 	// Заголовки до передачи тела
 	writeCommon(w, r, ct, etag, source, time.Since(start))
+	setLastModified(w, lastMod)
+	w.Header().Set("Accept-Ranges", "bytes")
 	if size > 0 {
 		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
 	}
 
-	w.WriteHeader(http.StatusOK)
+	if cr := aws.ToString(out.ContentRange); cr != "" {
+		w.Header().Set("Content-Range", cr)
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
 
 	// Стримим тело (не аллоцируем весь файл)
 	if _, err := io.Copy(w, out.Body); err != nil {
@@ -133,3 +168,41 @@ func (a *App) serveFromS3IfPresent(
 	}
 	return true, nil
 }
+
+// headFromS3IfPresent — HEAD без тела: только HeadObject (или GET первого байта, см. statObject).
+func (a *App) headFromS3IfPresent(
+	w http.ResponseWriter,
+	r *http.Request,
+	key string,
+	source string,
+	start time.Time,
+) (bool, error) {
+	info, ok, err := a.statObject(r.Context(), key)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if notModified(r, info.etag, info.lastModified) {
+		writeNotModified(w, r, info.contentType, info.etag, info.lastModified, source, time.Since(start))
+		return true, nil
+	}
+
+	writeCommon(w, r, info.contentType, info.etag, source, time.Since(start))
+	setLastModified(w, info.lastModified)
+	w.Header().Set("Accept-Ranges", "bytes")
+	if size := info.size; size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	return true, nil
+}
+
+// writeRangeNotSatisfiable отвечает 416; размер объекта узнаём через statObject, если получится.
+func (a *App) writeRangeNotSatisfiable(w http.ResponseWriter, r *http.Request, key string) {
+	if info, ok, err := a.statObject(r.Context(), key); err == nil && ok {
+		w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(info.size, 10))
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+}
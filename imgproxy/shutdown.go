@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+func newHTTPServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: envDuration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:       envDuration("HTTP_READ_TIMEOUT", 30*time.Second),
+		// 0 — без ограничения: большие оригиналы с медленного апстрима стримятся долго
+		WriteTimeout: envDuration("HTTP_WRITE_TIMEOUT", 0),
+		IdleTimeout:  envDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+	}
+}
+
+// shutdown: readyz -> 503, пауза, чтобы балансер успел убрать под, дожидаемся текущих запросов,
+// останавливаем фоновые задачи и доливаем очередь заливок. Всё вместе — не дольше SHUTDOWN_TIMEOUT.
+func (a *App) shutdown(srv *http.Server, stopJobs context.CancelFunc, jobsDone <-chan struct{}) {
+	a.shuttingDown.Store(true)
+	slog.Info("shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), envDuration("SHUTDOWN_TIMEOUT", 30*time.Second))
+	defer cancel()
+
+	select {
+	case <-time.After(envDuration("SHUTDOWN_DELAY", 5*time.Second)):
+	case <-ctx.Done():
+	}
+
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("http shutdown", "err", err)
+		srv.Close()
+	}
+
+	stopJobs()
+	select {
+	case <-jobsDone:
+	case <-ctx.Done():
+		slog.Warn("background jobs did not stop before deadline")
+	}
+
+	a.uploads.drain(ctx)
+	// после заливок: afterIngest ещё мог поставить задачи
+	a.jobs.flush(ctx)
+	slog.Info("shutdown complete")
+}
@@ -0,0 +1,136 @@
+// Package sign подписывает и проверяет URL вида /sss/{type}/{id}/{md5}[@size].
+//
+// Подпись — HMAC-SHA256 от пути и срока жизни, передаётся в query:
+//
+//	/sss/videos/1/abef0f58745b022a79cbb545d576f1e3@600?kid=k1&exp=1767225600&sig=...
+//
+// Бэкенд генерирует ссылки через Signer, imgproxy проверяет их через Verifier.
+// Ключей может быть несколько (kid) — так их можно ротировать без простоя.
+package sign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ParamKeyID     = "kid"
+	ParamExpires   = "exp"
+	ParamSignature = "sig"
+)
+
+var (
+	ErrMissing      = errors.New("sign: missing signature")
+	ErrUnknownKey   = errors.New("sign: unknown key id")
+	ErrBadSignature = errors.New("sign: bad signature")
+	ErrExpired      = errors.New("sign: url expired")
+)
+
+// Signer подписывает пути одним ключом.
+type Signer struct {
+	KeyID string
+	Key   []byte
+}
+
+// Query возвращает параметры подписи для path. Нулевой exp — ссылка бессрочная.
+func (s Signer) Query(path string, exp time.Time) url.Values {
+	q := url.Values{}
+	q.Set(ParamKeyID, s.KeyID)
+	var expStr string
+	if !exp.IsZero() {
+		expStr = strconv.FormatInt(exp.Unix(), 10)
+		q.Set(ParamExpires, expStr)
+	}
+	q.Set(ParamSignature, mac(s.Key, path, expStr))
+	return q
+}
+
+// URL склеивает base (https://img.example.com), path и подпись.
+func (s Signer) URL(base, path string, exp time.Time) string {
+	return strings.TrimSuffix(base, "/") + path + "?" + s.Query(path, exp).Encode()
+}
+
+// Verifier проверяет подписи набором активных ключей.
+type Verifier struct {
+	keys map[string][]byte
+}
+
+func NewVerifier(keys map[string][]byte) *Verifier {
+	return &Verifier{keys: keys}
+}
+
+// Verify проверяет подпись path по параметрам q на момент now.
+func (v *Verifier) Verify(path string, q url.Values, now time.Time) error {
+	sig := q.Get(ParamSignature)
+	if sig == "" {
+		return ErrMissing
+	}
+	expStr := q.Get(ParamExpires)
+
+	ok := false
+	if kid := q.Get(ParamKeyID); kid != "" {
+		key, found := v.keys[kid]
+		if !found {
+			return ErrUnknownKey
+		}
+		ok = equal(sig, mac(key, path, expStr))
+	} else {
+		// без kid пробуем все ключи
+		for _, key := range v.keys {
+			if equal(sig, mac(key, path, expStr)) {
+				ok = true
+				break
+			}
+		}
+	}
+	if !ok {
+		return ErrBadSignature
+	}
+
+	if expStr != "" {
+		exp, err := strconv.ParseInt(expStr, 10, 64)
+		if err != nil {
+			return ErrBadSignature
+		}
+		if now.Unix() > exp {
+			return ErrExpired
+		}
+	}
+	return nil
+}
+
+// ParseKeys разбирает "kid1:secret1,kid2:secret2" (запятые или переводы строк).
+func ParseKeys(s string) (map[string][]byte, error) {
+	keys := map[string][]byte{}
+	for _, item := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		item = strings.TrimSpace(item)
+		if item == "" || strings.HasPrefix(item, "#") {
+			continue
+		}
+		kid, secret, ok := strings.Cut(item, ":")
+		if !ok || kid == "" || secret == "" {
+			return nil, fmt.Errorf("sign: bad key %q: want kid:secret", kid)
+		}
+		keys[kid] = []byte(secret)
+	}
+	return keys, nil
+}
+
+func mac(key []byte, path, exp string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(path))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(exp))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func equal(a, b string) bool {
+	return hmac.Equal([]byte(a), []byte(b))
+}
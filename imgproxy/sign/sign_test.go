@@ -0,0 +1,156 @@
+package sign
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const testPath = "/sss/videos/1/abef0f58745b022a79cbb545d576f1e3@600"
+
+func testVerifier() *Verifier {
+	return NewVerifier(map[string][]byte{
+		"old": []byte("old-secret"),
+		"new": []byte("new-secret"),
+	})
+}
+
+func TestSignVerify(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	v := testVerifier()
+
+	for _, tc := range []struct {
+		name string
+		exp  time.Time
+	}{
+		{"no expiry", time.Time{}},
+		{"with expiry", now.Add(time.Hour)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := Signer{KeyID: "new", Key: []byte("new-secret")}.Query(testPath, tc.exp)
+			if err := v.Verify(testPath, q, now); err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestSignerURL(t *testing.T) {
+	s := Signer{KeyID: "new", Key: []byte("new-secret")}
+	u, err := url.Parse(s.URL("https://img.example.com/", testPath, time.Time{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != testPath {
+		t.Fatalf("path = %q, want %q", u.Path, testPath)
+	}
+	if err := testVerifier().Verify(u.Path, u.Query(), time.Now()); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+}
+
+// ротация: подпись старым ключом проходит, пока он в наборе, с kid и без него.
+func TestVerifyKeyRotation(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	old := Signer{KeyID: "old", Key: []byte("old-secret")}
+
+	t.Run("with kid", func(t *testing.T) {
+		if err := testVerifier().Verify(testPath, old.Query(testPath, time.Time{}), now); err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+	})
+	t.Run("without kid", func(t *testing.T) {
+		q := old.Query(testPath, time.Time{})
+		q.Del(ParamKeyID)
+		if err := testVerifier().Verify(testPath, q, now); err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+	})
+	t.Run("retired key", func(t *testing.T) {
+		v := NewVerifier(map[string][]byte{"new": []byte("new-secret")})
+		if err := v.Verify(testPath, old.Query(testPath, time.Time{}), now); !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("err = %v, want ErrUnknownKey", err)
+		}
+		q := old.Query(testPath, time.Time{})
+		q.Del(ParamKeyID)
+		if err := v.Verify(testPath, q, now); !errors.Is(err, ErrBadSignature) {
+			t.Fatalf("without kid: err = %v, want ErrBadSignature", err)
+		}
+	})
+	t.Run("kid of another key", func(t *testing.T) {
+		q := old.Query(testPath, time.Time{})
+		q.Set(ParamKeyID, "new")
+		if err := testVerifier().Verify(testPath, q, now); !errors.Is(err, ErrBadSignature) {
+			t.Fatalf("err = %v, want ErrBadSignature", err)
+		}
+	})
+}
+
+func TestVerifyExpired(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	s := Signer{KeyID: "new", Key: []byte("new-secret")}
+	q := s.Query(testPath, now.Add(-time.Second))
+	if err := testVerifier().Verify(testPath, q, now); !errors.Is(err, ErrExpired) {
+		t.Fatalf("err = %v, want ErrExpired", err)
+	}
+	// ровно в момент exp ссылка ещё жива
+	q = s.Query(testPath, now)
+	if err := testVerifier().Verify(testPath, q, now); err != nil {
+		t.Fatalf("at exp: %v", err)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	s := Signer{KeyID: "new", Key: []byte("new-secret")}
+	exp := now.Add(time.Hour)
+
+	for _, tc := range []struct {
+		name   string
+		path   string
+		mutate func(url.Values)
+		want   error
+	}{
+		{"other size", testPath[:len(testPath)-3] + "1000", nil, ErrBadSignature},
+		{"other id", "/sss/videos/2/abef0f58745b022a79cbb545d576f1e3@600", nil, ErrBadSignature},
+		{"exp extended", testPath, func(q url.Values) { q.Set(ParamExpires, "9999999999") }, ErrBadSignature},
+		{"exp removed", testPath, func(q url.Values) { q.Del(ParamExpires) }, ErrBadSignature},
+		{"exp not a number", testPath, func(q url.Values) { q.Set(ParamExpires, "soon") }, ErrBadSignature},
+		{"sig changed", testPath, func(q url.Values) { q.Set(ParamSignature, q.Get(ParamSignature)[1:]+"A") }, ErrBadSignature},
+		{"sig missing", testPath, func(q url.Values) { q.Del(ParamSignature) }, ErrMissing},
+		{"unknown kid", testPath, func(q url.Values) { q.Set(ParamKeyID, "nope") }, ErrUnknownKey},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := s.Query(testPath, exp)
+			if tc.mutate != nil {
+				tc.mutate(q)
+			}
+			if err := testVerifier().Verify(tc.path, q, now); !errors.Is(err, tc.want) {
+				t.Fatalf("err = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys("k1:secret1, k2:sec:ret2\n# comment\n\nk3:secret3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"k1": "secret1", "k2": "sec:ret2", "k3": "secret3"}
+	if len(keys) != len(want) {
+		t.Fatalf("got %d keys, want %d", len(keys), len(want))
+	}
+	for kid, secret := range want {
+		if string(keys[kid]) != secret {
+			t.Errorf("key %s = %q, want %q", kid, keys[kid], secret)
+		}
+	}
+
+	for _, bad := range []string{"k1", "k1:", ":secret", "k1:secret,k2"} {
+		if _, err := ParseKeys(bad); err == nil {
+			t.Errorf("ParseKeys(%q): want error", bad)
+		}
+	}
+}
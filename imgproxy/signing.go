@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"imgproxy/sign"
+)
+
+// loadURLVerifier включает проверку подписи, если заданы ключи.
+func loadURLVerifier() (*sign.Verifier, error) {
+	src := env("URL_SIGNING_KEYS", "")
+	if f := env("URL_SIGNING_KEYS_FILE", ""); f != "" {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("read URL_SIGNING_KEYS_FILE: %w", err)
+		}
+		src = string(b)
+	}
+	if src == "" {
+		return nil, nil
+	}
+	keys, err := sign.ParseKeys(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("URL_SIGNING_KEYS: no keys")
+	}
+	return sign.NewVerifier(keys), nil
+}
+
+// requireSignature отбивает неподписанные и криво подписанные запросы до любых походов в S3/БД.
+func (a *App) requireSignature(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.urlVerifier == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := a.urlVerifier.Verify(r.URL.Path, r.URL.Query(), time.Now()); err != nil {
+			a.writeError(w, r, newError(errForbidden, "invalid signature", err))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
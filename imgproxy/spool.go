@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+)
+
+// spool копит тело для асинхронной заливки в S3: маленькие держит в памяти,
+// большие сбрасывает во временный файл. Попутно считает md5 (он же ETag в S3).
+type spool struct {
+	mem   bytes.Buffer
+	f     *os.File
+	n     int64
+	limit int64
+	dir   string
+	sum   hash.Hash
+}
+
+func newSpool(memLimit int64, dir string) *spool {
+	return &spool{limit: memLimit, dir: dir, sum: md5.New()}
+}
+
+func spoolBytes(b []byte) *spool {
+	s := newSpool(int64(len(b)), "")
+	_, _ = s.Write(b)
+	return s
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.f == nil && int64(s.mem.Len()+len(p)) > s.limit {
+		if err := s.spill(); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if s.f != nil {
+		n, err = s.f.Write(p)
+	} else {
+		n, err = s.mem.Write(p)
+	}
+	s.n += int64(n)
+	s.sum.Write(p[:n])
+	return n, err
+}
+
+func (s *spool) Size() int64 { return s.n }
+
+// InMemory — сколько байт спул держит в памяти.
+func (s *spool) InMemory() int64 {
+	if s.f != nil {
+		return 0
+	}
+	return s.n
+}
+
+// spill переносит содержимое из памяти во временный файл.
+func (s *spool) spill() error {
+	if s.f != nil {
+		return nil
+	}
+	f, err := os.CreateTemp(s.dir, "imgproxy-spool-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(s.mem.Bytes()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	s.mem = bytes.Buffer{}
+	s.f = f
+	return nil
+}
+
+// persistTo сохраняет содержимое в path (для очереди заливок на диске).
+func (s *spool) persistTo(path string) error {
+	rd, err := s.Reader()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, rd); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// openSpoolFile открывает ранее сохранённый файл как спул; Close его удалит.
+func openSpoolFile(path string) (*spool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	s := &spool{f: f, sum: md5.New()}
+	n, err := io.Copy(s.sum, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.n = n
+	return s, nil
+}
+
+func (s *spool) MD5() string { return hex.EncodeToString(s.sum.Sum(nil)) }
+
+// Reader отдаёт содержимое с начала; для файла — тот же *os.File после Seek.
+func (s *spool) Reader() (io.ReadSeeker, error) {
+	if s.f == nil {
+		return bytes.NewReader(s.mem.Bytes()), nil
+	}
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.f, nil
+}
+
+func (s *spool) Close() error {
+	s.mem = bytes.Buffer{}
+	if s.f == nil {
+		return nil
+	}
+	name := s.f.Name()
+	err := s.f.Close()
+	os.Remove(name)
+	s.f = nil
+	return err
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// capability — результат пробы одной операции хранилища.
+type capability struct {
+	Status string `json:"status"` // ok, denied, error, unknown
+	Error  string `json:"error,omitempty"`
+}
+
+// allowed: unknown (проба выключена или не дошла) считаем разрешённым — как было до проб.
+func (c capability) allowed() bool { return c.Status != "denied" }
+
+// storageCaps — что нам можно в бакете. Get и Put обязательны, без остального работаем в урезанном режиме.
+type storageCaps struct {
+	Get     capability `json:"get"`
+	Put     capability `json:"put"`
+	Head    capability `json:"head"`
+	Delete  capability `json:"delete"`
+	List    capability `json:"list"`
+	Checked time.Time  `json:"checked"`
+}
+
+func unknownStorageCaps() *storageCaps {
+	u := capability{Status: "unknown"}
+	return &storageCaps{Get: u, Put: u, Head: u, Delete: u, List: u}
+}
+
+func probeResult(op string, err error) capability {
+	c := capability{Status: "ok"}
+	switch {
+	case err == nil:
+	case isS3AccessDenied(err):
+		c = capability{Status: "denied", Error: err.Error()}
+	default:
+		c = capability{Status: "error", Error: err.Error()}
+	}
+	v := 0.0
+	if c.Status == "ok" {
+		v = 1
+	}
+	storageCapability.WithLabelValues(op).Set(v)
+	return c
+}
+
+func (a *App) storage() *storageCaps { return a.caps.Load() }
+
+// probeStorage проверяет все операции на служебных ключах и сохраняет отчёт в App.
+func (a *App) probeStorage(ctx context.Context) *storageCaps {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	probeBase := fmt.Sprintf("%s/__init_access_probe/%d", a.probePrefix(), time.Now().UnixNano())
+	missKey := probeBase + "-read-miss"
+	writeKey := probeBase + "-write"
+
+	caps := &storageCaps{Checked: time.Now()}
+	caps.Get = probeResult("get", a.checkS3Read(ctx, missKey))
+
+	_, err := a.s3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(a.bucket),
+		Key:         aws.String(writeKey),
+		Body:        bytes.NewReader([]byte("ok")),
+		ContentType: aws.String("text/plain"),
+	})
+	caps.Put = probeResult("put", err)
+
+	_, err = a.s3.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(a.bucket), Key: aws.String(missKey)})
+	if err != nil && isS3NotFound(err) {
+		err = nil
+	}
+	caps.Head = probeResult("head", err)
+
+	_, err = a.s3.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(a.bucket),
+		Prefix:  aws.String(probeBase),
+		MaxKeys: aws.Int32(1),
+	})
+	caps.List = probeResult("list", err)
+
+	// удаляем то, что записали; если записать не вышло — удаляем несуществующий ключ, S3 отвечает 204
+	_, err = a.s3.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(a.bucket), Key: aws.String(writeKey)})
+	caps.Delete = probeResult("delete", err)
+
+	a.caps.Store(caps)
+	return caps
+}
+
+// checkS3Access — проба при старте: без Get/Put работать нельзя, остальное только логируем.
+func (a *App) checkS3Access(ctx context.Context) error {
+	caps := a.probeStorage(ctx)
+	for _, c := range []struct {
+		op string
+		c  capability
+	}{{"get", caps.Get}, {"put", caps.Put}, {"head", caps.Head}, {"delete", caps.Delete}, {"list", caps.List}} {
+		slog.Info("s3 capability", "op", c.op, "status", c.c.Status, "err", c.c.Error)
+	}
+	if caps.Get.Status != "ok" {
+		return fmt.Errorf("s3 read check failed (GetObject): %s", caps.Get.Error)
+	}
+	if caps.Put.Status != "ok" {
+		return fmt.Errorf("s3 write check failed (PutObject): %s", caps.Put.Error)
+	}
+	if !caps.Head.allowed() {
+		slog.Warn("s3 head access denied, continue without HeadObject (ranged GET instead)")
+	}
+	if !caps.Delete.allowed() {
+		slog.Warn("s3 delete access denied, purge is disabled")
+	}
+	return nil
+}
+
+// objectInfo — то, что обычно узнаём через HeadObject.
+type objectInfo struct {
+	contentType  string
+	etag         string
+	lastModified time.Time
+	size         int64
+	meta         map[string]string
+}
+
+// statObject — HeadObject, а если он запрещён — GET первого байта. ok == false — объекта нет.
+func (a *App) statObject(ctx context.Context, key string) (objectInfo, bool, error) {
+	defer stage(ctx, "storage")()
+	if a.storage().Head.allowed() {
+		out, err := a.s3.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &a.bucket, Key: &key})
+		if err != nil {
+			if isS3NotFound(err) {
+				return objectInfo{}, false, nil
+			}
+			return objectInfo{}, false, err
+		}
+		return objectInfo{
+			contentType:  aws.ToString(out.ContentType),
+			etag:         objectETag(out.Metadata, out.ETag),
+			lastModified: aws.ToTime(out.LastModified),
+			size:         aws.ToInt64(out.ContentLength),
+			meta:         out.Metadata,
+		}, true, nil
+	}
+
+	out, err := a.s3.GetObject(ctx, &s3.GetObjectInput{Bucket: &a.bucket, Key: &key, Range: aws.String("bytes=0-0")})
+	if err != nil {
+		switch {
+		case isS3NotFound(err):
+			return objectInfo{}, false, nil
+		case isS3InvalidRange(err):
+			// пустой объект
+			return objectInfo{}, true, nil
+		}
+		return objectInfo{}, false, err
+	}
+	out.Body.Close()
+	info := objectInfo{
+		contentType:  aws.ToString(out.ContentType),
+		etag:         objectETag(out.Metadata, out.ETag),
+		lastModified: aws.ToTime(out.LastModified),
+		size:         aws.ToInt64(out.ContentLength),
+		meta:         out.Metadata,
+	}
+	// Content-Range: bytes 0-0/12345
+	if _, total, ok := strings.Cut(aws.ToString(out.ContentRange), "/"); ok {
+		if n, err := strconv.ParseInt(total, 10, 64); err == nil {
+			info.size = n
+		}
+	}
+	return info, true, nil
+}
+
+// handleAdminStorage — отчёт о правах в бакете; ?refresh=1 — перепроверить.
+func (a *App) handleAdminStorage(w http.ResponseWriter, r *http.Request) {
+	caps := a.storage()
+	if envBoolValue(r.URL.Query().Get("refresh")) {
+		caps = a.probeStorage(r.Context())
+	}
+	writeJSON(w, http.StatusOK, caps)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reqTrace — этапы запроса (storage, resolve, fetch, decode, resize, encode, upload).
+// Одноимённые этапы складываются. Уходит в Server-Timing и, для медленных запросов, в лог.
+type reqTrace struct {
+	mu     sync.Mutex
+	start  time.Time
+	stages []traceStage
+}
+
+type traceStage struct {
+	name string
+	dur  time.Duration
+}
+
+type ctxKeyTrace struct{}
+
+func traceFrom(ctx context.Context) *reqTrace {
+	t, _ := ctx.Value(ctxKeyTrace{}).(*reqTrace)
+	return t
+}
+
+// stage засекает этап: defer stage(ctx, "fetch")(). Без трейса в контексте (фоновые задачи) — no-op.
+func stage(ctx context.Context, name string) func() {
+	t := traceFrom(ctx)
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() { t.add(name, time.Since(start)) }
+}
+
+func (t *reqTrace) add(name string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.stages {
+		if t.stages[i].name == name {
+			t.stages[i].dur += d
+			return
+		}
+	}
+	t.stages = append(t.stages, traceStage{name, d})
+}
+
+// header — "storage;dur=1.2, fetch;dur=80.5, total;dur=95.0".
+func (t *reqTrace) header() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parts := make([]string, 0, len(t.stages)+1)
+	for _, s := range t.stages {
+		parts = append(parts, fmt.Sprintf("%s;dur=%.1f", s.name, ms(s.dur)))
+	}
+	parts = append(parts, fmt.Sprintf("total;dur=%.1f", ms(time.Since(t.start))))
+	return strings.Join(parts, ", ")
+}
+
+func (t *reqTrace) attrs() []any {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]any, 0, len(t.stages))
+	for _, s := range t.stages {
+		out = append(out, slog.Float64(s.name+"_ms", ms(s.dur)))
+	}
+	return out
+}
+
+func ms(d time.Duration) float64 { return float64(d.Microseconds()) / 1000.0 }
+
+// timingWriter дописывает Server-Timing в момент отправки заголовков —
+// этапы после этого (стрим тела) в заголовок уже не попадут, только в лог.
+type timingWriter struct {
+	http.ResponseWriter
+	trace       *reqTrace
+	wroteHeader bool
+}
+
+func (w *timingWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set("Server-Timing", w.trace.header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timingWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// withTrace — трейс на запрос; запросы дольше SLOW_REQUEST_THRESHOLD логируются с разбивкой по этапам.
+func withTrace(next http.Handler) http.Handler {
+	slow := envDuration("SLOW_REQUEST_THRESHOLD", time.Second)
+	serverTiming := envBool("SERVER_TIMING", true)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := &reqTrace{start: time.Now()}
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeyTrace{}, t))
+		if serverTiming {
+			w = &timingWriter{ResponseWriter: w, trace: t}
+		}
+		next.ServeHTTP(w, r)
+
+		if total := time.Since(t.start); slow > 0 && total >= slow {
+			slog.WarnContext(r.Context(), "slow request",
+				slog.String("path", r.URL.Path),
+				slog.Float64("duration_ms", ms(total)),
+				slog.Group("stages", t.attrs()...),
+			)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("imgproxy")
+
+// setupTracing — OTEL_TRACES_EXPORTER: none (default), otlp (OTLP/HTTP, адрес и заголовки —
+// стандартные OTEL_EXPORTER_OTLP_*), stdout. Сэмплер — стандартный OTEL_TRACES_SAMPLER(_ARG).
+// Возвращает функцию, которая дописывает буфер спанов при выключении.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	// traceparent разбираем всегда: request_id и логи от этого не зависят, а прокидывать дальше дёшево
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exp sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(env("OTEL_TRACES_EXPORTER", "none")) {
+	case "none", "":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exp, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+	default:
+		return nil, fmt.Errorf("bad OTEL_TRACES_EXPORTER %q: want none, otlp or stdout", env("OTEL_TRACES_EXPORTER", ""))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("trace exporter: %w", err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(attribute.String("service.name", env("OTEL_SERVICE_NAME", "imgproxy"))),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("trace resource: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan закрывает спан; err != nil помечает его ошибкой.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// withTracing — серверный спан на запрос, родитель — W3C traceparent из запроса, если он есть.
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("request_id", requestID(r.Context())),
+		))
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		// имя по шаблону маршрута, а не по пути: иначе у каждой картинки своё имя спана
+		if route := chi.RouteContext(r.Context()).RoutePattern(); route != "" {
+			span.SetName(r.Method + " " + route)
+			span.SetAttributes(attribute.String("http.route", route))
+		}
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// traceS3 — спан на каждый вызов S3 (GetObject, PutObject, HeadObject…). 404 ошибкой не считаем: промах кеша — норма.
+func traceS3(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("imgproxyTrace",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			op := awsmiddleware.GetOperationName(ctx)
+			ctx, span := tracer.Start(ctx, "s3."+op, trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(attribute.String("rpc.system", "aws-api"), attribute.String("rpc.method", op)))
+			out, md, err := next.HandleInitialize(ctx, in)
+			if err != nil && isS3NotFound(err) {
+				span.SetAttributes(attribute.Bool("s3.not_found", true))
+				endSpan(span, nil)
+			} else {
+				endSpan(span, err)
+			}
+			return out, md, err
+		}), middleware.After)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// uploadTask — одна заливка в S3. ingest != nil — это новый оригинал, после заливки запускаем пресеты.
+type uploadTask struct {
+	Key      string            `json:"key"`
+	CT       string            `json:"ct"`
+	Meta     map[string]string `json:"meta,omitempty"`
+	Attempts int               `json:"attempts"`
+	Queued   time.Time         `json:"queued"`
+	Ingest   *ingestRef        `json:"ingest,omitempty"`
+
+	body *spool
+	link trace.SpanContext // спан запроса, который поставил заливку (на диск не сохраняется)
+}
+
+type ingestRef struct {
+	Type string `json:"type"`
+	ID   int    `json:"id"`
+	Hash string `json:"hash"`
+}
+
+// uploadQueue — ограниченная очередь заливок с ретраями. Когда очередь полна, под закрытием
+// или после исчерпания попыток на выключении, задача сохраняется на диск (spillDir) и подхватывается позже,
+// в том числе после рестарта. Когда в памяти слишком много байт, тела уходят во временные файлы.
+type uploadQueue struct {
+	a           *App
+	ch          chan *uploadTask
+	workers     int
+	maxAttempts int
+	backoff     time.Duration
+	timeout     time.Duration
+	maxMem      int64
+	spillDir    string
+
+	memBytes atomic.Int64
+	closed   atomic.Bool
+	mu       sync.Mutex // закрытие ch против enqueue
+	wg       sync.WaitGroup
+	stop     chan struct{}
+	ctx      context.Context // отменяется вместе со stop: рвёт заливки, начатые до дедлайна
+	cancel   context.CancelFunc
+
+	tombMu sync.Mutex
+	tombs  map[string]time.Time // purge: префикс ключа -> когда удалили
+}
+
+func newUploadQueue(a *App) (*uploadQueue, error) {
+	q := &uploadQueue{
+		a:           a,
+		ch:          make(chan *uploadTask, int(envInt64("UPLOAD_QUEUE", 1024))),
+		workers:     int(envInt64("UPLOAD_WORKERS", 32)),
+		maxAttempts: int(envInt64("UPLOAD_MAX_ATTEMPTS", 5)),
+		backoff:     envDuration("UPLOAD_RETRY_BACKOFF", time.Second),
+		timeout:     envDuration("UPLOAD_TIMEOUT", 30*time.Second),
+		maxMem:      envInt64("UPLOAD_QUEUE_MEM_BYTES", 256<<20),
+		spillDir:    env("UPLOAD_SPILL_DIR", filepath.Join(os.TempDir(), "imgproxy-uploads")),
+		stop:        make(chan struct{}),
+		tombs:       map[string]time.Time{},
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	if err := os.MkdirAll(q.spillDir, 0o755); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *uploadQueue) start() {
+	q.removeOrphans()
+	for i := 0; i < max(q.workers, 1); i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+	go q.loadSpilled()
+}
+
+func (q *uploadQueue) enqueue(t *uploadTask) {
+	if t.Queued.IsZero() {
+		t.Queued = time.Now()
+	}
+	if q.memBytes.Load()+t.body.InMemory() > q.maxMem {
+		// память под очередью кончилась — тело во временный файл
+		if err := t.body.spill(); err != nil {
+			slog.Warn("upload spill to tmp failed", "key", t.Key, "err", err)
+		}
+	}
+
+	q.mu.Lock()
+	if !q.closed.Load() {
+		select {
+		case q.ch <- t:
+			q.memBytes.Add(t.body.InMemory())
+			uploadQueueDepth.Inc()
+			q.mu.Unlock()
+			return
+		default:
+		}
+	}
+	q.mu.Unlock()
+	// запись на диск — уже без лока, иначе под перегрузкой все запросы выстроятся за одним диском
+	q.persist(t)
+}
+
+func (q *uploadQueue) worker() {
+	defer q.wg.Done()
+	for t := range q.ch {
+		uploadQueueDepth.Dec()
+		q.memBytes.Add(-t.body.InMemory())
+		q.process(t)
+	}
+}
+
+func (q *uploadQueue) process(t *uploadTask) {
+	for {
+		if q.stopped() {
+			// дедлайн drain прошёл — не начинаем заливку, сохраняем на диск
+			q.persist(t)
+			return
+		}
+		if q.forgotten(t) {
+			slog.Info("upload skipped, purged after enqueue", "key", t.Key)
+			t.body.Close()
+			return
+		}
+		t.Attempts++
+		// заливка живёт дольше запроса: отдельный корневой спан со ссылкой на спан запроса
+		ctx, span := tracer.Start(q.ctx, "upload", trace.WithNewRoot(),
+			trace.WithLinks(trace.Link{SpanContext: t.link}),
+			trace.WithAttributes(attribute.String("s3.key", t.Key), attribute.Int("upload.attempt", t.Attempts)))
+		ctx, cancel := context.WithTimeout(ctx, q.timeout)
+		_, err := q.a.putObject(ctx, t.Key, t.CT, t.body, t.Meta)
+		cancel()
+		endSpan(span, err)
+		if err != nil && q.stopped() {
+			// заливку оборвал дедлайн drain — попытка не в счёт, задача уходит на диск
+			t.Attempts--
+			q.persist(t)
+			return
+		}
+		if err == nil {
+			slog.Debug("async upload ok", "key", t.Key)
+			t.body.Close()
+			if t.Ingest != nil {
+				q.a.afterIngest(t.Ingest.Type, t.Ingest.ID, t.Ingest.Hash)
+			}
+			return
+		}
+		if t.Attempts >= q.maxAttempts {
+			slog.Error("async upload failed permanently", "key", t.Key, "attempts", t.Attempts, "err", err)
+			uploadFailures.Inc()
+			t.body.Close()
+			return
+		}
+		slog.Warn("async upload failed", "key", t.Key, "attempt", t.Attempts, "err", err)
+		uploadRetries.Inc()
+
+		select {
+		case <-time.After(q.backoff << (t.Attempts - 1)):
+		case <-q.stop:
+			// выключаемся — не ждём паузу, сохраняем задачу на диск
+			q.persist(t)
+			return
+		}
+	}
+}
+
+func (q *uploadQueue) stopped() bool {
+	select {
+	case <-q.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// persist сохраняет задачу на диск: <name>.body + <name>.json.
+func (q *uploadQueue) persist(t *uploadTask) {
+	defer t.body.Close()
+	base := filepath.Join(q.spillDir, newRequestID())
+	if err := t.body.persistTo(base + ".body"); err != nil {
+		slog.Error("upload persist failed, dropped", "key", t.Key, "err", err)
+		uploadFailures.Inc()
+		return
+	}
+	b, _ := json.Marshal(t)
+	err := os.WriteFile(base+".json.tmp", b, 0o644)
+	if err == nil {
+		err = os.Rename(base+".json.tmp", base+".json")
+	}
+	if err != nil {
+		slog.Error("upload persist failed, dropped", "key", t.Key, "err", err)
+		os.Remove(base + ".json.tmp")
+		os.Remove(base + ".body")
+		uploadFailures.Inc()
+		return
+	}
+	uploadSpilled.Inc()
+}
+
+// removeOrphans удаляет .body без .json: persist упал (или процесс умер) между записью тела
+// и переименованием .json, такую задачу уже не восстановить. Свежие файлы не трогаем —
+// если каталог общий, их прямо сейчас может дописывать другой процесс.
+func (q *uploadQueue) removeOrphans() {
+	bodies, err := filepath.Glob(filepath.Join(q.spillDir, "*.body"))
+	if err != nil {
+		return
+	}
+	for _, b := range bodies {
+		base := strings.TrimSuffix(b, ".body")
+		fi, err := os.Stat(b)
+		if err != nil || time.Since(fi.ModTime()) < time.Minute {
+			continue
+		}
+		if _, err := os.Stat(base + ".json"); errors.Is(err, os.ErrNotExist) {
+			slog.Warn("upload spill without task, removed", "file", b)
+			os.Remove(b)
+			os.Remove(base + ".json.tmp")
+		}
+	}
+}
+
+// loadSpilled периодически возвращает задачи с диска в очередь, когда в ней есть место.
+func (q *uploadQueue) loadSpilled() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		if q.closed.Load() {
+			return
+		}
+		q.loadSpilledOnce(cap(q.ch)/2 - len(q.ch))
+		select {
+		case <-q.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (q *uploadQueue) loadSpilledOnce(room int) {
+	if room <= 0 {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(q.spillDir, "*.json"))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if room <= 0 {
+			return
+		}
+		base := strings.TrimSuffix(f, ".json")
+		b, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		var t uploadTask
+		if err := json.Unmarshal(b, &t); err != nil {
+			slog.Error("upload spill is corrupt, dropped", "file", f, "err", err)
+			os.Remove(f)
+			os.Remove(base + ".body")
+			continue
+		}
+		body, err := openSpoolFile(base + ".body")
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				os.Remove(f)
+			}
+			continue
+		}
+		os.Remove(f)
+		t.body = body
+		q.enqueue(&t)
+		room--
+	}
+}
+
+// drain закрывает приём и ждёт, пока воркеры разгребут очередь. На дедлайне отменяет контекст
+// очереди: идущие заливки обрываются, а воркеры, увидев stop, сохраняют свои задачи на диск
+// вместо новых попыток; остаток в канале сохраняем сами.
+func (q *uploadQueue) drain(ctx context.Context) {
+	q.mu.Lock()
+	q.closed.Store(true)
+	close(q.ch)
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		q.cancel()
+		slog.Info("upload queue drained")
+		return
+	case <-ctx.Done():
+	}
+
+	close(q.stop)
+	q.cancel()
+	// воркеры тоже доедают канал, но уже не заливают, а сохраняют на диск
+	for t := range q.ch {
+		uploadQueueDepth.Dec()
+		q.persist(t)
+	}
+	<-done
+	slog.Warn("upload queue drain deadline reached, rest saved", "dir", q.spillDir)
+}
+
+// forget — purge: задачи под prefix, поставленные до at, заливать уже не надо (в них старое содержимое).
+func (q *uploadQueue) forget(prefix string, at time.Time) {
+	q.tombMu.Lock()
+	defer q.tombMu.Unlock()
+	for p, ts := range q.tombs {
+		if at.Sub(ts) > 24*time.Hour {
+			delete(q.tombs, p)
+		}
+	}
+	q.tombs[prefix] = at
+}
+
+func (q *uploadQueue) forgotten(t *uploadTask) bool {
+	q.tombMu.Lock()
+	defer q.tombMu.Unlock()
+	for p, at := range q.tombs {
+		if strings.HasPrefix(t.Key, p) && !t.Queued.After(at) {
+			return true
+		}
+	}
+	return false
+}
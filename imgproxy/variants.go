@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+func (a *App) objectKey(typ string, id int, name string) string {
+	return fmt.Sprintf("%s/%s/%d/%s", a.prefix, typ, id, name)
+}
+
+func variantName(hash, resize string) string {
+	if resize == "" {
+		return hash
+	}
+	return hash + "@" + resize
+}
+
+// largerVariants — ресайзы того же измерения крупнее resize, по возрастанию: 600 -> 700..1000, h600 -> h700..h1000.
+func largerVariants(resize string) []string {
+	w, h, err := parseResize(resize)
+	if err != nil {
+		return nil
+	}
+	var out []string
+	if h > 0 {
+		for v := h + 100; v <= 1000; v += 100 {
+			out = append(out, "h"+strconv.Itoa(v))
+		}
+		return out
+	}
+	for v := w + 100; v <= 1000; v += 100 {
+		out = append(out, strconv.Itoa(v))
+	}
+	return out
+}
+
+// variantJob — один ресайз, либо (resize == "") все пресеты типа разом.
+type variantJob struct {
+	typ    string
+	id     int
+	hash   string
+	resize string
+}
+
+func (j variantJob) String() string {
+	return fmt.Sprintf("%s/%d/%s", j.typ, j.id, variantName(j.hash, j.resize))
+}
+
+// renderVariant генерирует ресайз в фоне и заливает его в S3. Воркер пула занимает только когда
+// живые запросы не ждут в очереди.
+func (a *App) renderVariant(ctx context.Context, j variantJob) error {
+	if j.resize == "" {
+		_, err := a.renderPresets(ctx, j.typ, j.id, j.hash, false)
+		return err
+	}
+	src, err := a.openVariantSource(ctx, j.typ, j.id, j.hash, j.resize)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	release, err := a.resizePool.acquireIdle(ctx)
+	if err != nil {
+		src.finish(ctx, true)
+		return err
+	}
+	resized, size, err := resizeToWebP(ctx, src.rd, j.resize)
+	release()
+	src.finish(ctx, err == nil)
+	if err != nil {
+		return err
+	}
+	a.uploadAsync(ctx, a.objectKey(j.typ, j.id, variantName(j.hash, j.resize)), "image/webp", spoolBytes(resized), src.lineageMeta(size))
+	return nil
+}
+
+// variantSource — откуда рендерим ресайз: готовый крупный ресайз, оригинал в S3 или оригинал из апстрима.
+type variantSource struct {
+	rd    io.Reader
+	label string // для X-B-Source: orig-cache, remote, derived-800
+	code  int
+
+	lineage      string // из чего сделан ресайз: "orig" или имя ресайза
+	origW, origH int    // размер оригинала, если он известен без декодирования
+
+	closers []io.Closer
+
+	// оригинал из апстрима, который надо залить в S3
+	app     *App
+	origKey string
+	origCT  string
+	sp      *spool
+	ingest  ingestRef
+}
+
+func (s *variantSource) Close() {
+	for _, c := range s.closers {
+		c.Close()
+	}
+	if s.sp != nil {
+		s.sp.Close()
+	}
+}
+
+// finish заливает скачанный из апстрима оригинал (если ok) или выбрасывает его.
+func (s *variantSource) finish(ctx context.Context, ok bool) {
+	if s.sp == nil {
+		return
+	}
+	if ok {
+		s.app.uploadIngest(ctx, s.origKey, s.origCT, s.sp, s.ingest.Type, s.ingest.ID, s.ingest.Hash)
+	} else {
+		s.sp.Close()
+	}
+	s.sp = nil
+}
+
+// lineageMeta — метаданные ресайза: из чего сделан и какого размера был оригинал.
+// По ним планировщик решает, годится ли ресайз как источник для ресайзов поменьше.
+func (s *variantSource) lineageMeta(decoded image.Point) map[string]string {
+	w, h := s.origW, s.origH
+	if s.lineage == "orig" {
+		w, h = decoded.X, decoded.Y
+	}
+	meta := map[string]string{"lineage": s.lineage}
+	if w > 0 && h > 0 {
+		meta["orig-w"] = strconv.Itoa(w)
+		meta["orig-h"] = strconv.Itoa(h)
+	}
+	return meta
+}
+
+func (a *App) openVariantSource(ctx context.Context, typ string, id int, hash, resize string) (*variantSource, error) {
+	if src, err := a.planDerivation(ctx, typ, id, hash, resize); err != nil || src != nil {
+		if err != nil {
+			slog.WarnContext(ctx, "derive plan failed, fallback to original", "variant", fmt.Sprintf("%s/%d/%s", typ, id, variantName(hash, resize)), "err", err)
+		} else {
+			return src, nil
+		}
+	}
+	return a.openOriginalSource(ctx, typ, id, hash)
+}
+
+// openOriginalSource — оригинал из S3, а если его там нет — из апстрима (с последующей заливкой).
+func (a *App) openOriginalSource(ctx context.Context, typ string, id int, hash string) (*variantSource, error) {
+	origKey := a.objectKey(typ, id, hash)
+	body, _, _, ok, err := a.openObject(ctx, origKey)
+	if err != nil {
+		return nil, storageError("storage error", err)
+	}
+	if ok {
+		return &variantSource{rd: body, label: "orig-cache", code: 200, lineage: "orig", closers: []io.Closer{body}}, nil
+	}
+
+	remote, err := a.openRemoteOriginal(ctx, typ, id, hash)
+	if err != nil {
+		return nil, err
+	}
+	src := &variantSource{label: "remote", code: remote.code, lineage: "orig", closers: []io.Closer{remote}, app: a}
+	// сначала докачиваем оригинал в спул (он же пойдёт в S3), чтобы медленный апстрим
+	// не держал воркер ресайза
+	sp := a.newSpool()
+	if _, err := io.Copy(sp, remote); err != nil {
+		sp.Close()
+		remote.Close()
+		return nil, err
+	}
+	rd, err := sp.Reader()
+	if err != nil {
+		sp.Close()
+		remote.Close()
+		return nil, err
+	}
+	src.rd = rd
+	src.sp = sp
+	src.origKey = origKey
+	src.origCT = remote.contentType
+	src.ingest = ingestRef{Type: typ, ID: id, Hash: hash}
+	return src, nil
+}
+
+// nearestVariants — чем можно подменить resize: ресайзы крупнее, потом оригинал.
+func nearestVariants(hash, resize string) []string {
+	var out []string
+	for _, v := range largerVariants(resize) {
+		out = append(out, variantName(hash, v))
+	}
+	return append(out, hash)
+}
+
+func variantLabel(name string) string {
+	if _, resize, ok := strings.Cut(name, "@"); ok {
+		return resize
+	}
+	return "orig"
+}
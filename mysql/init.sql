@@ -51,3 +51,70 @@ INSERT INTO `screenshots` (`id`, `url`) VALUES
 (3, 'https://storage.kinohd.co/6ef1180730622cf42f377fcb2400c6b4:2055010101/movies/c7a4d501a626d4c7a991400e198b8d44536d6b29/thumb003.jpg');
 
 
+
+
+-- очередь фоновой генерации ресайзов; imgproxy создаёт её и сам (JOB_QUEUE=mysql)
+CREATE TABLE IF NOT EXISTS imgproxy_jobs (
+  id bigint unsigned NOT NULL AUTO_INCREMENT,
+  type varchar(32) NOT NULL,
+  entity_id int NOT NULL,
+  hash char(32) NOT NULL,
+  variant varchar(16) NOT NULL DEFAULT '',
+  attempts int NOT NULL DEFAULT 0,
+  run_after datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  locked_until datetime NULL,
+  owner varchar(32) NULL,
+  last_error varchar(255) NULL,
+  created_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (id),
+  UNIQUE KEY uniq_job (type, entity_id, hash, variant),
+  KEY run_after (run_after)
+);
+
+
+-- журнал смены URL картинок (CHANGE_FEED=true); imgproxy создаёт таблицу и сам, триггеры — только здесь.
+-- UPDATE без смены URL тоже пишется (old_url = new_url): картинка у апстрима могла смениться по тому же адресу,
+-- imgproxy перекачает её и сравнит md5 с оригиналом в S3 — если совпал, кеш не трогается.
+CREATE TABLE IF NOT EXISTS imgproxy_changes (
+  id bigint unsigned NOT NULL AUTO_INCREMENT,
+  type varchar(32) NOT NULL,
+  entity_id int NOT NULL,
+  old_url varchar(255) NULL,
+  new_url varchar(255) NULL,
+  attempts int NOT NULL DEFAULT 0,
+  last_error varchar(255) NULL,
+  created_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (id)
+);
+
+CREATE TRIGGER videos_imgproxy_upd AFTER UPDATE ON videos FOR EACH ROW
+  INSERT INTO imgproxy_changes (type, entity_id, old_url, new_url)
+  SELECT 'videos', NEW.id, OLD.img, NEW.img FROM DUAL WHERE NOT (OLD.img <=> NEW.img) OR NEW.img <> ''
+  UNION ALL
+  SELECT 'videos', NEW.id, OLD.backdrop, NEW.backdrop FROM DUAL WHERE NOT (OLD.backdrop <=> NEW.backdrop) OR NEW.backdrop <> '';
+CREATE TRIGGER videos_imgproxy_del AFTER DELETE ON videos FOR EACH ROW
+  INSERT INTO imgproxy_changes (type, entity_id, old_url, new_url)
+  SELECT 'videos', OLD.id, OLD.img, NULL FROM DUAL WHERE OLD.img <> ''
+  UNION ALL
+  SELECT 'videos', OLD.id, OLD.backdrop, NULL FROM DUAL WHERE OLD.backdrop <> '';
+
+CREATE TRIGGER actors_imgproxy_upd AFTER UPDATE ON actors FOR EACH ROW
+  INSERT INTO imgproxy_changes (type, entity_id, old_url, new_url)
+  SELECT 'actors', NEW.id, OLD.poster_url, NEW.poster_url FROM DUAL WHERE NOT (OLD.poster_url <=> NEW.poster_url) OR NEW.poster_url IS NOT NULL;
+CREATE TRIGGER actors_imgproxy_del AFTER DELETE ON actors FOR EACH ROW
+  INSERT INTO imgproxy_changes (type, entity_id, old_url, new_url)
+  SELECT 'actors', OLD.id, OLD.poster_url, NULL FROM DUAL WHERE OLD.poster_url IS NOT NULL;
+
+CREATE TRIGGER directors_imgproxy_upd AFTER UPDATE ON directors FOR EACH ROW
+  INSERT INTO imgproxy_changes (type, entity_id, old_url, new_url)
+  SELECT 'directors', NEW.id, OLD.poster_url, NEW.poster_url FROM DUAL WHERE NOT (OLD.poster_url <=> NEW.poster_url) OR NEW.poster_url IS NOT NULL;
+CREATE TRIGGER directors_imgproxy_del AFTER DELETE ON directors FOR EACH ROW
+  INSERT INTO imgproxy_changes (type, entity_id, old_url, new_url)
+  SELECT 'directors', OLD.id, OLD.poster_url, NULL FROM DUAL WHERE OLD.poster_url IS NOT NULL;
+
+CREATE TRIGGER screenshots_imgproxy_upd AFTER UPDATE ON screenshots FOR EACH ROW
+  INSERT INTO imgproxy_changes (type, entity_id, old_url, new_url)
+  SELECT 'screenshots', NEW.id, OLD.url, NEW.url FROM DUAL WHERE NOT (OLD.url <=> NEW.url) OR NEW.url <> '';
+CREATE TRIGGER screenshots_imgproxy_del AFTER DELETE ON screenshots FOR EACH ROW
+  INSERT INTO imgproxy_changes (type, entity_id, old_url, new_url)
+  SELECT 'screenshots', OLD.id, OLD.url, NULL FROM DUAL;